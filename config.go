@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envBool reads a boolean setting from the environment, falling back to def
+// when the variable is unset or malformed.
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid boolean environment variable, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return b
+}
+
+// envInt reads an integer setting from the environment, falling back to def
+// when the variable is unset or malformed.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid integer environment variable, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a duration such as "30s" from the environment, falling
+// back to def when the variable is unset or malformed.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid duration environment variable, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return d
+}
+
+// envList reads a comma separated list from the environment, trimming
+// spaces and dropping empty entries.
+func envList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
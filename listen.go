@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// listen opens the listener configured by the environment: a Unix socket
+// when LISTEN_SOCKET is set, otherwise TCP on LISTEN_ADDR. The returned TLS
+// config is non-nil when TLS_CERT_FILE and TLS_KEY_FILE are set.
+func listen() (net.Listener, *tls.Config, error) {
+	tlsConfig, err := loadTLSConfig(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if path := os.Getenv("LISTEN_SOCKET"); path != "" {
+		mode, err := parseFileMode(os.Getenv("LISTEN_SOCKET_MODE"), 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+		ln, err := listenUnix(path, mode)
+		return ln, tlsConfig, err
+	}
+
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":11434"
+	}
+	ln, err := net.Listen("tcp", addr)
+	return ln, tlsConfig, err
+}
+
+// listenUnix listens on a Unix socket at path with the given permissions,
+// replacing a socket left behind by a previous run. The socket is created
+// in a private directory next to path and only renamed into place once its
+// permissions are set, so no client can connect while it still has the
+// umask's permissions.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// MkdirTemp creates the directory with mode 0700
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would unlink the temporary name on close
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// unixListener removes its socket file when closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// parseFileMode parses an octal permission string such as "660".
+func parseFileMode(value string, def fs.FileMode) (fs.FileMode, error) {
+	if value == "" {
+		return def, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q, want octal permissions such as 660", value)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// loadTLSConfig returns the server TLS config, or nil when certFile is
+// empty. With a clientCAFile, clients must present a certificate signed by
+// one of its CAs.
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certs.Watch(5 * time.Second)
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certReloader serves a certificate from disk and reloads it when the
+// certificate or key file changes, so renewed certificates are picked up
+// without a restart.
+type certReloader struct {
+	certFile, keyFile string
+	current           atomic.Pointer[tls.Certificate]
+	modTime           time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current.Load(), nil
+}
+
+// reload loads the certificate again if either file changed since the last
+// load. A pair that fails to load, such as one caught halfway through a
+// renewal, keeps the previous certificate in place.
+func (r *certReloader) reload() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	if modTime.Equal(r.modTime) {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.modTime = modTime
+	r.current.Store(&cert)
+	return true, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Watch reloads the certificate on SIGHUP and whenever the files'
+// modification times change, checking every interval.
+func (r *certReloader) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hup:
+				// Force a reload even if the modification times match
+				r.modTime = time.Time{}
+			case <-ticker.C:
+			}
+			reloaded, err := r.reload()
+			if err != nil {
+				slog.Error("Error reloading TLS certificate, keeping the previous one", "Error", err)
+			} else if reloaded {
+				slog.Info("Reloaded TLS certificate", "file", r.certFile)
+			}
+		}
+	}()
+}
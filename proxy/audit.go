@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Timestamp        time.Time              `json:"timestamp"`
+	Route            string                 `json:"route"`
+	User             string                 `json:"user"`
+	UserAgent        string                 `json:"user_agent,omitempty"`
+	RequestedModel   string                 `json:"requested_model,omitempty"`
+	ResolvedModel    string                 `json:"resolved_model,omitempty"`
+	Stream           bool                   `json:"stream"`
+	Options          map[string]interface{} `json:"options,omitempty"`
+	MessageCount     int                    `json:"message_count"`
+	PromptTokens     int                    `json:"prompt_tokens"`
+	CompletionTokens int                    `json:"completion_tokens"`
+	LatencyMS        int64                  `json:"latency_ms"`
+	Status           int                    `json:"status"`
+	FinishReason     string                 `json:"finish_reason,omitempty"`
+	Error            string                 `json:"error,omitempty"`
+	// Redactions counts the values masked before forwarding, per rule.
+	Redactions map[string]int `json:"redactions,omitempty"`
+	// Cached is set when the response was served from the response cache.
+	Cached bool `json:"cached,omitempty"`
+	// ContextDropped counts the messages dropped or summarized to fit the
+	// model's context window.
+	ContextDropped int `json:"context_dropped,omitempty"`
+
+	// Bodies are only filled when the logger is configured to include them.
+	Messages []openai.ChatCompletionMessage `json:"messages,omitempty"`
+	Response string                         `json:"response,omitempty"`
+	// Truncated is set when a body was cut to the configured size cap.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// AuditRedactor may rewrite a record before it is written, e.g. to mask
+// secrets in message bodies.
+type AuditRedactor func(*AuditRecord)
+
+// AuditLogger writes AuditRecords as JSON lines to a rotating file.
+type AuditLogger struct {
+	out          *rotatingFile
+	IncludeBody  bool
+	MaxBodyBytes int
+	Redact       AuditRedactor
+}
+
+// NewAuditLogger opens the audit log at path. The file is rotated once it
+// exceeds maxBytes, keeping maxBackups old files; zero maxBytes disables
+// rotation.
+func NewAuditLogger(path string, maxBytes int64, maxBackups int) (*AuditLogger, error) {
+	out, err := openRotatingFile(path, maxBytes, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLogger{out: out}, nil
+}
+
+// Write finalizes and writes a record. Bodies are redacted before they are
+// capped, so truncation cannot cut a secret in half and hide it from the
+// redaction rules.
+func (l *AuditLogger) Write(rec *AuditRecord) error {
+	if !l.IncludeBody {
+		rec.Messages = nil
+		rec.Response = ""
+	}
+	if l.Redact != nil {
+		l.Redact(rec)
+	}
+	if l.IncludeBody && l.MaxBodyBytes > 0 {
+		l.capBodies(rec)
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = l.out.Write(append(line, '\n'))
+	return err
+}
+
+// capBodies truncates the message and response bodies so together they stay
+// within MaxBodyBytes.
+func (l *AuditLogger) capBodies(rec *AuditRecord) {
+	budget := l.MaxBodyBytes
+	capped := make([]openai.ChatCompletionMessage, 0, len(rec.Messages))
+	for _, m := range rec.Messages {
+		if budget <= 0 {
+			rec.Truncated = true
+			break
+		}
+		if len(m.Content) > budget {
+			m.Content = truncateUTF8(m.Content, budget)
+			rec.Truncated = true
+		}
+		budget -= len(m.Content)
+		capped = append(capped, m)
+	}
+	rec.Messages = capped
+
+	if len(rec.Response) > max(budget, 0) {
+		rec.Response = truncateUTF8(rec.Response, max(budget, 0))
+		rec.Truncated = true
+	}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// rotatingFile is an append-only file that is renamed to path.1, path.2, ...
+// once it grows beyond maxBytes.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups > 0 {
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Close closes the underlying file.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+const auditRecordKey = "auditRecord"
+
+// auditRecord returns the request's audit record. When auditing is disabled
+// it returns a throwaway record so handlers can fill it unconditionally.
+func auditRecord(c *gin.Context) *AuditRecord {
+	if v, ok := c.Get(auditRecordKey); ok {
+		return v.(*AuditRecord)
+	}
+	rec := &AuditRecord{}
+	c.Set(auditRecordKey, rec)
+	return rec
+}
+
+// errorCapture keeps the start of error responses so the audit log can
+// record why a request failed.
+type errorCapture struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+const maxCapturedError = 1024
+
+func (w *errorCapture) Write(p []byte) (int, error) {
+	if w.Status() >= 400 && w.body.Len() < maxCapturedError {
+		w.body.Write(p[:min(len(p), maxCapturedError-w.body.Len())])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *errorCapture) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// auditMiddleware writes an audit record for every request to the given
+// routes once the handler has finished.
+func auditMiddleware(logger *AuditLogger, routes ...string) gin.HandlerFunc {
+	audited := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		audited[route] = true
+	}
+
+	return func(c *gin.Context) {
+		if !audited[c.FullPath()] || c.Request.Method != "POST" {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		rec := &AuditRecord{
+			Timestamp: start.UTC(),
+			Route:     c.FullPath(),
+			UserAgent: c.Request.UserAgent(),
+		}
+		c.Set(auditRecordKey, rec)
+		capture := &errorCapture{ResponseWriter: c.Writer}
+		c.Writer = capture
+
+		c.Next()
+
+		rec.User = clientName(c)
+		rec.LatencyMS = time.Since(start).Milliseconds()
+		rec.Status = c.Writer.Status()
+		if rec.Error == "" && capture.body.Len() > 0 {
+			var body struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(capture.body.Bytes(), &body) == nil && body.Error != "" {
+				rec.Error = body.Error
+			} else {
+				rec.Error = capture.body.String()
+			}
+		}
+
+		if err := logger.Write(rec); err != nil {
+			slog.Error("Error writing audit log", "Error", err)
+		}
+	}
+}
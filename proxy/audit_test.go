@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// readAudit returns the records written to the audit log at path.
+func readAudit(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := NewAuditLogger(path, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.out.Close()
+
+	for _, user := range []string{"a", "b", "c", "d", "e"} {
+		if err := logger.Write(&AuditRecord{User: user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each record is a little over half the limit, so every file holds one
+	// and only the newest two backups are kept
+	for file, want := range map[string]string{"": "e", ".1": "d", ".2": "c"} {
+		records := readAudit(t, path+file)
+		if len(records) != 1 || records[0].User != want {
+			t.Errorf("audit.log%s = %+v, want the record of %s", file, records, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("third backup kept: %v", err)
+	}
+}
+
+func TestAuditCapBodies(t *testing.T) {
+	logger := &AuditLogger{IncludeBody: true, MaxBodyBytes: 10}
+	for _, tc := range []struct {
+		name      string
+		messages  []string
+		response  string
+		want      []string
+		wantReply string
+		truncated bool
+	}{
+		{"within the cap", []string{"hi"}, "hello", []string{"hi"}, "hello", false},
+		{"long response", []string{"hi"}, "hello world", []string{"hi"}, "hello wo", true},
+		{"long message", []string{"hello world"}, "ok", []string{"hello worl"}, "", true},
+		{"later messages dropped", []string{"0123456789", "more"}, "", []string{"0123456789"}, "", true},
+		// "é" is two bytes; cutting after its first byte would write invalid UTF-8
+		{"multibyte", []string{"héé", "ééé"}, "", []string{"héé", "éé"}, "", true},
+	} {
+		rec := &AuditRecord{Response: tc.response}
+		for _, content := range tc.messages {
+			rec.Messages = append(rec.Messages, openai.ChatCompletionMessage{Content: content})
+		}
+		logger.capBodies(rec)
+
+		var got []string
+		for _, m := range rec.Messages {
+			got = append(got, m.Content)
+		}
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") || rec.Response != tc.wantReply || rec.Truncated != tc.truncated {
+			t.Errorf("%s: messages %q, response %q, truncated %v; want %q, %q, %v",
+				tc.name, got, rec.Response, rec.Truncated, tc.want, tc.wantReply, tc.truncated)
+		}
+	}
+}
+
+func TestAuditRedactsBodies(t *testing.T) {
+	redactor, err := NewRedactor([]string{"email"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactor.Restore = true
+	path := filepath.Join(t.TempDir(), "audit.log")
+	p := newTestProxy(t, func(o *Options) {
+		o.Redactor = redactor
+		o.AuditLog, err = NewAuditLogger(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.AuditLog.IncludeBody = true
+		o.AuditLog.Redact = redactor.Audit()
+	})
+	// The model echoes the placeholder, which is restored for the client
+	p.upstream.Script(fakeResponse{Chunks: []string{"Mail [REDACTED_EMAIL_1] back"}})
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "I am bob@example.com"}},
+	})
+	expectStatus(t, w, http.StatusOK)
+	if !strings.Contains(w.Body.String(), "bob@example.com") {
+		t.Fatalf("response not restored: %s", w.Body)
+	}
+
+	records := readAudit(t, path)
+	if len(records) != 1 {
+		t.Fatalf("audit records = %d, want 1", len(records))
+	}
+	if data, _ := json.Marshal(records[0]); strings.Contains(string(data), "bob@example.com") {
+		t.Errorf("audit record holds the email: %s", data)
+	}
+	if records[0].Response != "Mail [REDACTED_EMAIL_1] back" {
+		t.Errorf("audited response = %q", records[0].Response)
+	}
+}
+
+func TestAuditRejectedRequests(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(tokensFile, []byte(`[{"token": "user-token", "user": "alice"}]`), 0o600)
+	tokens, err := LoadTokenStore(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	p := newTestProxy(t, func(o *Options) {
+		o.Tokens = tokens
+		o.AuditLog, err = NewAuditLogger(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+	})
+	expectStatus(t, w, http.StatusUnauthorized)
+
+	records := readAudit(t, path)
+	if len(records) != 1 {
+		t.Fatalf("audit records = %d, want 1", len(records))
+	}
+	if rec := records[0]; rec.Status != http.StatusUnauthorized || rec.Route != "/api/chat" || rec.Error == "" || rec.User != "127.0.0.1" {
+		t.Errorf("audit record = %+v", rec)
+	}
+}
+
+func TestAuditContextSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	p := newTestProxy(t, func(o *Options) {
+		o.Context = &ContextConfig{Strategy: ContextSummarize, SummaryModel: "openai/gpt-4o-mini"}
+		var err error
+		o.AuditLog, err = NewAuditLogger(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.AuditLog.IncludeBody = true
+	})
+	p.upstream.Script(fakeResponse{Chunks: []string{"They counted letters."}}, fakeResponse{Chunks: []string{"h"}})
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 150)), http.StatusOK)
+
+	// The summary call is written first, as a record of its own
+	records := readAudit(t, path)
+	if len(records) != 2 {
+		t.Fatalf("audit records = %d, want 2", len(records))
+	}
+	summary, chat := records[0], records[1]
+	if summary.Route != summaryAuditRoute || summary.ResolvedModel != "openai/gpt-4o-mini" || summary.Status != http.StatusOK ||
+		summary.Response != "They counted letters." || summary.User != "127.0.0.1" || len(summary.Messages) != 2 {
+		t.Errorf("summary record = %+v", summary)
+	}
+
+	// The chat record holds the messages sent upstream, summary included
+	sent := p.upstream.Requests()[1].Messages
+	if chat.Route != "/api/chat" || chat.MessageCount != 8 || chat.ContextDropped == 0 {
+		t.Errorf("chat record = %+v", chat)
+	}
+	if firstChars(chat.Messages) != firstChars(sent) || !strings.Contains(chat.Messages[1].Content, "They counted letters.") {
+		t.Errorf("audited messages %q, sent %q", firstChars(chat.Messages), firstChars(sent))
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProxyUser is a client of the proxy identified by a bearer token.
+type ProxyUser struct {
+	Name     string
+	Disabled bool
+	Admin    bool // May use the /admin/ endpoints
+	// Models restricts which models the user may list and call. It uses the
+	// models-filter rule syntax; an empty filter allows every model.
+	Models *ModelFilter
+	// APIKey is the user's own OpenRouter key. Requests from the user are
+	// billed to it instead of the proxy's key when set.
+	APIKey string
+}
+
+// tokenFileEntry is one entry of the tokens file:
+//
+//	[
+//	  {"token": "s3cret", "user": "alice", "models": ["openai/*", "!*:free"]},
+//	  {"token": "0ther", "user": "bob", "openrouter_key": "sk-or-...", "disabled": true},
+//	  {"token": "r00t", "user": "ops", "admin": true}
+//	]
+type tokenFileEntry struct {
+	Token         string   `json:"token"`
+	User          string   `json:"user"`
+	Models        []string `json:"models"`
+	Disabled      bool     `json:"disabled"`
+	Admin         bool     `json:"admin"`
+	OpenrouterKey string   `json:"openrouter_key"`
+}
+
+// TokenStore maps bearer tokens to proxy users. Tokens are kept hashed so
+// lookups do not compare secrets byte by byte.
+type TokenStore struct {
+	users map[[sha256.Size]byte]*ProxyUser
+}
+
+// LoadTokenStore reads a JSON tokens file.
+func LoadTokenStore(path string) (*TokenStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []tokenFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing tokens file: %w", err)
+	}
+
+	store := &TokenStore{users: make(map[[sha256.Size]byte]*ProxyUser, len(entries))}
+	for i, entry := range entries {
+		if entry.Token == "" || entry.User == "" {
+			return nil, fmt.Errorf("tokens file entry %d: token and user are required", i)
+		}
+		models, err := ParseModelFilter(strings.NewReader(strings.Join(entry.Models, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("tokens file entry %d (%s): %w", i, entry.User, err)
+		}
+		key := sha256.Sum256([]byte(entry.Token))
+		if _, exists := store.users[key]; exists {
+			return nil, fmt.Errorf("tokens file entry %d (%s): duplicate token", i, entry.User)
+		}
+		store.users[key] = &ProxyUser{
+			Name:     entry.User,
+			Disabled: entry.Disabled,
+			Admin:    entry.Admin,
+			Models:   models,
+			APIKey:   entry.OpenrouterKey,
+		}
+	}
+
+	return store, nil
+}
+
+// Lookup returns the user for a token, or nil if the token is unknown.
+func (s *TokenStore) Lookup(token string) *ProxyUser {
+	return s.users[sha256.Sum256([]byte(token))]
+}
+
+// Len returns the number of configured tokens.
+func (s *TokenStore) Len() int {
+	return len(s.users)
+}
+
+const proxyUserKey = "proxyUser"
+
+// userFromContext returns the authenticated user, or nil when authentication
+// is disabled or was skipped for a local client.
+func userFromContext(c *gin.Context) *ProxyUser {
+	if v, ok := c.Get(proxyUserKey); ok {
+		return v.(*ProxyUser)
+	}
+	return nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// isLoopback reports whether the request comes from the local machine.
+// Connections over a Unix socket count as local; the socket's file
+// permissions decide who may connect.
+func isLoopback(r *http.Request) bool {
+	if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isOpenrouterKey reports whether a bearer token is an OpenRouter API key
+// rather than a proxy token.
+func isOpenrouterKey(token string) bool {
+	return strings.HasPrefix(token, "sk-or-")
+}
+
+// authMiddleware requires a valid bearer token on every /api/ and /admin/
+// route. When allowLocal is set, clients connecting over loopback may omit
+// the token. With passthrough, clients may present their own OpenRouter key
+// instead on the passthroughRoutes.
+func authMiddleware(store *TokenStore, allowLocal, passthrough bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if !strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/admin/") {
+			c.Next()
+			return
+		}
+
+		token := bearerToken(c.Request)
+		if token == "" && allowLocal && isLoopback(c.Request) {
+			c.Next()
+			return
+		}
+		if passthrough && isOpenrouterKey(token) && passthroughRoutes[c.Request.Method+" "+path] {
+			c.Next()
+			return
+		}
+
+		user := store.Lookup(token)
+		if user == nil {
+			c.Header("WWW-Authenticate", `Bearer realm="ollama-proxy"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if user.Disabled {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "user " + user.Name + " is disabled"})
+			return
+		}
+
+		c.Set(proxyUserKey, user)
+		c.Next()
+	}
+}
+
+// passthroughRoutes are the routes a client may call with its own OpenRouter
+// key instead of a proxy token. They forward the request upstream with that
+// key, so OpenRouter checks it; routes answered by the proxy alone would let
+// any token starting with "sk-or-" in.
+var passthroughRoutes = map[string]bool{
+	"POST /api/chat":     true,
+	"POST /api/generate": true,
+}
+
+const passthroughClientKey = "passthroughClient"
+
+// isPassthroughClient reports whether the request carries the client's own
+// OpenRouter key.
+func isPassthroughClient(c *gin.Context) bool {
+	return c.GetBool(passthroughClientKey)
+}
+
+// upstreamKeyMiddleware selects the OpenRouter key for the request: a key
+// supplied by the client in pass-through mode, otherwise the authenticated
+// user's own key. Requests without either use the proxy's key.
+func upstreamKeyMiddleware(passthrough bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey := ""
+		if token := bearerToken(c.Request); passthrough && isOpenrouterKey(token) {
+			apiKey = token
+			c.Set(passthroughClientKey, true)
+		} else if user := userFromContext(c); user != nil {
+			apiKey = user.APIKey
+		}
+
+		if apiKey != "" {
+			c.Request = c.Request.WithContext(WithUpstreamKey(c.Request.Context(), apiKey))
+		}
+		c.Next()
+	}
+}
+
+// adminOnly restricts a route to admin users. Local clients are admins only
+// when no tokens are configured, or when authEnabled and allowLocal let them
+// in without a token; a local client presenting a non-admin token or its own
+// OpenRouter key is not.
+func adminOnly(authEnabled, allowLocal bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := userFromContext(c)
+		local := isLoopback(c.Request) && (!authEnabled || (allowLocal && bearerToken(c.Request) == ""))
+		if (user != nil && user.Admin) || (user == nil && local) {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+	}
+}
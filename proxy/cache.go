@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// CachedResponse is a completed upstream response. Chunks holds the streamed
+// deltas so a hit can be replayed as a similar stream; it is empty for
+// responses that were not streamed.
+type CachedResponse struct {
+	Content      string       `json:"content"`
+	Chunks       []string     `json:"chunks,omitempty"`
+	FinishReason string       `json:"finish_reason"`
+	Usage        openai.Usage `json:"usage"`
+	StoredAt     time.Time    `json:"stored_at"`
+}
+
+// chunks returns the pieces to replay, splitting unstreamed content after
+// each run of whitespace so it arrives word by word.
+func (r *CachedResponse) chunks() []string {
+	if len(r.Chunks) > 0 {
+		return r.Chunks
+	}
+	var chunks []string
+	start := 0
+	for i, ch := range r.Content {
+		if !unicode.IsSpace(ch) {
+			continue
+		}
+		next := i + utf8.RuneLen(ch)
+		if following, _ := utf8.DecodeRuneInString(r.Content[next:]); next < len(r.Content) && !unicode.IsSpace(following) {
+			chunks = append(chunks, r.Content[start:next])
+			start = next
+		}
+	}
+	if start < len(r.Content) {
+		chunks = append(chunks, r.Content[start:])
+	}
+	return chunks
+}
+
+// CacheBackend stores responses by key. Backends do not expire entries;
+// ResponseCache checks the TTL on read.
+type CacheBackend interface {
+	Get(key string) (*CachedResponse, bool)
+	Put(key string, resp *CachedResponse) error
+	Delete(key string)
+}
+
+// ResponseCache caches responses to deterministic requests, those with a
+// temperature of 0 or a fixed seed. A nil ResponseCache never hits.
+type ResponseCache struct {
+	backend CacheBackend
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+// NewResponseCache creates a cache on backend. Zero ttl keeps entries until
+// the backend evicts them.
+func NewResponseCache(backend CacheBackend, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{backend: backend, ttl: ttl, now: time.Now}
+}
+
+// Key returns the cache key for a request, or "" if the request is not
+// deterministic and must not be cached. Messages should be the ones sent
+// upstream, after redaction.
+func (rc *ResponseCache) Key(model string, messages []openai.ChatCompletionMessage, options map[string]interface{}) string {
+	if rc == nil {
+		return ""
+	}
+	temperature, hasTemperature := optionFloat(options, "temperature")
+	_, hasSeed := optionFloat(options, "seed")
+	if !(hasTemperature && temperature == 0) && !hasSeed {
+		return ""
+	}
+
+	// Options that do not change the completion must not split the cache.
+	sampling := make(map[string]interface{}, len(options))
+	for k, v := range options {
+		if k != "keep_alive" && k != "num_thread" && k != "num_gpu" {
+			sampling[k] = v
+		}
+	}
+	data, err := json.Marshal(struct {
+		Model    string                         `json:"model"`
+		Messages []openai.ChatCompletionMessage `json:"messages"`
+		Options  map[string]interface{}         `json:"options"`
+	}{model, messages, sampling})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached response for key, if any and not expired.
+func (rc *ResponseCache) Get(key string) (*CachedResponse, bool) {
+	if rc == nil || key == "" {
+		return nil, false
+	}
+	resp, ok := rc.backend.Get(key)
+	if ok && rc.ttl > 0 && rc.now().Sub(resp.StoredAt) > rc.ttl {
+		rc.backend.Delete(key)
+		ok = false
+	}
+	cacheRequests.WithLabelValues("response", cacheResult(ok)).Inc()
+	return resp, ok
+}
+
+// Put stores a response under key. Truncated or failed responses are not
+// cached.
+func (rc *ResponseCache) Put(key string, resp *CachedResponse) {
+	if rc == nil || key == "" || resp.FinishReason != string(openai.FinishReasonStop) {
+		return
+	}
+	resp.StoredAt = rc.now()
+	if err := rc.backend.Put(key, resp); err != nil {
+		slog.Warn("Error storing cached response", "Error", err)
+	}
+}
+
+// memoryCache is an in-memory LRU backend.
+type memoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // Front is most recently used
+	entries  map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+// newMemoryCache creates an LRU backend holding up to capacity responses.
+func newMemoryCache(capacity int) *memoryCache {
+	return &memoryCache{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (m *memoryCache) Get(key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return el.Value.(*memoryEntry).resp, true
+}
+
+func (m *memoryCache) Put(key string, resp *CachedResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		el.Value.(*memoryEntry).resp = resp
+		m.order.MoveToFront(el)
+		return nil
+	}
+	m.entries[key] = m.order.PushFront(&memoryEntry{key: key, resp: resp})
+	for m.capacity > 0 && m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+func (m *memoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.order.Remove(el)
+		delete(m.entries, key)
+	}
+}
+
+// diskCache stores one JSON file per key in a directory, so entries survive
+// restarts and can be shared between CI runs.
+type diskCache struct {
+	dir string
+}
+
+// newDiskCache creates a disk backend in dir, creating it if needed.
+func newDiskCache(dir string) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &diskCache{dir: dir}, nil
+}
+
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, key+".json")
+}
+
+func (d *diskCache) Get(key string) (*CachedResponse, bool) {
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Error reading cached response", "Error", err)
+		}
+		return nil, false
+	}
+	var resp CachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		slog.Warn("Discarding corrupt cached response", "key", key, "Error", err)
+		d.Delete(key)
+		return nil, false
+	}
+	return &resp, true
+}
+
+func (d *diskCache) Put(key string, resp *CachedResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename so readers never see a partial
+	// entry.
+	tmp, err := os.CreateTemp(d.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(key))
+}
+
+func (d *diskCache) Delete(key string) {
+	os.Remove(d.path(key))
+}
+
+// NewCacheBackend creates the backend named by kind: "memory" or "disk".
+func NewCacheBackend(kind, dir string, size int) (CacheBackend, error) {
+	switch strings.ToLower(kind) {
+	case "memory":
+		return newMemoryCache(size), nil
+	case "disk":
+		if dir == "" {
+			return nil, errors.New("RESPONSE_CACHE_DIR is required for the disk cache")
+		}
+		return newDiskCache(dir)
+	default:
+		return nil, fmt.Errorf("unknown response cache %q, want memory or disk", kind)
+	}
+}
+
+// replayCached writes a cached response in the route's Ollama format. body
+// builds an object carrying content in the route's field; done objects get
+// the usage counts added. Streams are replayed chunk by chunk as NDJSON.
+func replayCached(c *gin.Context, resp *CachedResponse, stream bool, redactions *Redactions, body func(content string, done bool) gin.H) {
+	c.Header("X-Cache", "hit")
+
+	final := func(content string) gin.H {
+		b := body(content, true)
+		b["done"] = true
+		b["done_reason"] = resp.FinishReason
+		b["total_duration"] = 0
+		b["load_duration"] = 0
+		b["prompt_eval_count"] = resp.Usage.PromptTokens
+		b["prompt_eval_duration"] = 0
+		b["eval_count"] = resp.Usage.CompletionTokens
+		b["eval_duration"] = 0
+		return b
+	}
+
+	if !stream {
+		c.JSON(http.StatusOK, final(redactions.Restore(resp.Content)))
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	w := c.Writer
+	restore := redactions.Stream()
+	write := func(b gin.H) {
+		data, err := json.Marshal(b)
+		if err != nil {
+			slog.Error("Error marshaling cached response JSON", "Error", err)
+			return
+		}
+		fmt.Fprintf(w, "%s\n", data)
+		w.Flush()
+	}
+
+	for _, chunk := range resp.chunks() {
+		b := body(restore.Next(chunk), false)
+		b["done"] = false
+		write(b)
+	}
+	if rest := restore.Flush(); rest != "" {
+		b := body(rest, false)
+		b["done"] = false
+		write(b)
+	}
+	write(final(""))
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestResponseCacheKey(t *testing.T) {
+	rc := NewResponseCache(newMemoryCache(10), time.Hour)
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}
+
+	tests := []struct {
+		name      string
+		options   map[string]interface{}
+		cacheable bool
+	}{
+		{"no options", nil, false},
+		{"default temperature", map[string]interface{}{"temperature": 0.7}, false},
+		{"zero temperature", map[string]interface{}{"temperature": 0.0}, true},
+		{"seed", map[string]interface{}{"temperature": 0.7, "seed": 42.0}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := rc.Key("openai/gpt-4o", messages, tt.options); (key != "") != tt.cacheable {
+				t.Errorf("Key() = %q, cacheable = %v", key, tt.cacheable)
+			}
+		})
+	}
+
+	zero := map[string]interface{}{"temperature": 0.0}
+	if rc.Key("openai/gpt-4o", messages, zero) == rc.Key("openai/gpt-4o-mini", messages, zero) {
+		t.Error("different models share a cache key")
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rc := NewResponseCache(newMemoryCache(10), time.Hour)
+	rc.now = func() time.Time { return now }
+
+	rc.Put("k", &CachedResponse{Content: "hello", FinishReason: "stop"})
+	rc.Put("truncated", &CachedResponse{Content: "hel", FinishReason: "length"})
+	if _, ok := rc.Get("k"); !ok {
+		t.Fatal("fresh entry missed")
+	}
+	if _, ok := rc.Get("truncated"); ok {
+		t.Fatal("truncated response was cached")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, ok := rc.Get("k"); ok {
+		t.Fatal("expired entry hit")
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	m := newMemoryCache(2)
+	m.Put("a", &CachedResponse{})
+	m.Put("b", &CachedResponse{})
+	m.Get("a")
+	m.Put("c", &CachedResponse{})
+
+	if _, ok := m.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	if _, ok := m.Get("a"); !ok {
+		t.Error("a should have been kept")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	d, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &CachedResponse{Content: "hi there", Chunks: []string{"hi", " there"}, FinishReason: "stop"}
+	if err := d.Put("k", want); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := d.Get("k")
+	if !ok || got.Content != want.Content || len(got.Chunks) != 2 {
+		t.Fatalf("Get = %+v, %v", got, ok)
+	}
+}
+
+func TestCachedResponseChunks(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    []string
+	}{
+		{"The quick  brown fox", []string{"The ", "quick  ", "brown ", "fox"}},
+		// Ideographic and no-break spaces are several bytes long
+		{"你好\u3000世界", []string{"你好\u3000", "世界"}},
+		{"a\u00a0b c", []string{"a\u00a0", "b ", "c"}},
+		{"x \u3000y", []string{"x \u3000", "y"}},
+		{"end\u3000", []string{"end\u3000"}},
+	} {
+		resp := &CachedResponse{Content: tc.content}
+		chunks := resp.chunks()
+		if !reflect.DeepEqual(chunks, tc.want) {
+			t.Errorf("chunks(%q) = %q, want %q", tc.content, chunks, tc.want)
+		}
+		for _, chunk := range chunks {
+			if !utf8.ValidString(chunk) {
+				t.Errorf("chunks(%q) split a character: %q", tc.content, chunk)
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// transcript is a golden Ollama exchange from testdata/conformance. See the
+// README there for the format.
+type transcript struct {
+	Description string          `json:"description"`
+	Setup       []setupStep     `json:"setup"`
+	Request     transcriptCall  `json:"request"`
+	Response    transcriptReply `json:"response"`
+	Optional    []string        `json:"optional"`
+	Freeform    []string        `json:"freeform"`
+}
+
+type setupStep struct {
+	transcriptCall
+	Allowlist bool `json:"allowlist"`
+}
+
+type transcriptCall struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Body   interface{} `json:"body"`
+}
+
+type transcriptReply struct {
+	Status      int           `json:"status"`
+	ContentType string        `json:"content_type"`
+	Body        interface{}   `json:"body"`
+	Lines       []interface{} `json:"lines"`
+}
+
+func TestOllamaConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "conformance", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no conformance transcripts found")
+	}
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tr transcript
+			if err := json.Unmarshal(data, &tr); err != nil {
+				t.Fatalf("parsing %s: %v", file, err)
+			}
+			runTranscript(t, &tr)
+		})
+	}
+}
+
+func runTranscript(t *testing.T, tr *transcript) {
+	var opts Options
+	for _, step := range tr.Setup {
+		opts.EnforceAllowlist = opts.EnforceAllowlist || step.Allowlist
+	}
+	p := newTestProxy(t, func(o *Options) { *o = opts })
+	p.upstream.Script(fakeResponse{Chunks: []string{"The", " sky", " is", " blue"}}, fakeResponse{Chunks: []string{"The", " sky"}})
+	for _, step := range tr.Setup {
+		if step.Allowlist {
+			continue
+		}
+		if w := p.do(t, step.Method, step.Path, step.Body); w.Code != http.StatusOK {
+			t.Fatalf("setup %s %s: status %d: %s", step.Method, step.Path, w.Code, w.Body.String())
+		}
+	}
+
+	w := p.do(t, tr.Request.Method, tr.Request.Path, tr.Request.Body)
+	if w.Code != tr.Response.Status {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, tr.Response.Status, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tr.Response.ContentType) {
+		t.Errorf("Content-Type = %q, want %q", ct, tr.Response.ContentType)
+	}
+
+	shape := shapeChecker{optional: tr.Optional, freeform: tr.Freeform}
+	if tr.Response.Lines == nil {
+		var got interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("response is not JSON: %v\n%s", err, w.Body.String())
+		}
+		for _, problem := range shape.compare("", tr.Response.Body, got) {
+			t.Error(problem)
+		}
+		return
+	}
+
+	lines := checkNDJSONFraming(t, w.Body.Bytes())
+	want := tr.Response.Lines
+	for i, line := range lines {
+		var problems []string
+		switch i {
+		case 0:
+			problems = shape.compare("line 1", want[0], line)
+		case len(lines) - 1:
+			problems = shape.compare(fmt.Sprintf("line %d (last)", i+1), want[len(want)-1], line)
+		default:
+			problems = shape.compareAny(fmt.Sprintf("line %d", i+1), want, line)
+		}
+		for _, problem := range problems {
+			t.Error(problem)
+		}
+	}
+}
+
+// checkNDJSONFraming verifies that body is newline terminated JSON objects
+// without SSE prefixes or blank lines, and that only the last object is
+// marked done, then returns the decoded objects.
+func checkNDJSONFraming(t *testing.T, body []byte) []interface{} {
+	t.Helper()
+	if len(body) == 0 || body[len(body)-1] != '\n' {
+		t.Fatalf("NDJSON stream does not end with a newline: %q", body)
+	}
+
+	var lines []interface{}
+	for i, raw := range bytes.Split(body[:len(body)-1], []byte("\n")) {
+		if len(bytes.TrimSpace(raw)) == 0 {
+			t.Fatalf("blank line %d in NDJSON stream", i+1)
+		}
+		if bytes.HasPrefix(raw, []byte("data:")) {
+			t.Fatalf("line %d uses SSE framing: %s", i+1, raw)
+		}
+		var line map[string]interface{}
+		if err := json.Unmarshal(raw, &line); err != nil {
+			t.Fatalf("line %d is not a JSON object: %v: %s", i+1, err, raw)
+		}
+		lines = append(lines, line)
+	}
+
+	for i, line := range lines {
+		done, hasDone := line.(map[string]interface{})["done"].(bool)
+		if hasDone && done != (i == len(lines)-1) {
+			t.Errorf("line %d has done=%v, only the last line may be done", i+1, done)
+		}
+	}
+	return lines
+}
+
+// shapeChecker compares the structure of a response with a golden one.
+// Paths name fields with dots and array elements with "[]".
+type shapeChecker struct {
+	optional []string
+	freeform []string
+}
+
+func (s shapeChecker) is(list []string, path string) bool {
+	for _, p := range list {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// compareAny succeeds if got has the shape of any of the candidates and
+// otherwise reports the differences to the closest one.
+func (s shapeChecker) compareAny(path string, candidates []interface{}, got interface{}) []string {
+	var best []string
+	for i, want := range candidates {
+		problems := s.compare(path, want, got)
+		if len(problems) == 0 {
+			return nil
+		}
+		if i == 0 || len(problems) < len(best) {
+			best = problems
+		}
+	}
+	return best
+}
+
+func (s shapeChecker) compare(path string, want, got interface{}) []string {
+	if jsonType(want) != jsonType(got) {
+		return []string{fmt.Sprintf("%s: got %s, want %s", describePath(path), jsonType(got), jsonType(want))}
+	}
+
+	switch want := want.(type) {
+	case map[string]interface{}:
+		if s.is(s.freeform, path) {
+			return nil
+		}
+		got := got.(map[string]interface{})
+		var problems []string
+		for _, key := range sortedKeys(want) {
+			child := joinPath(path, key)
+			value, ok := got[key]
+			if !ok {
+				if !s.is(s.optional, child) {
+					problems = append(problems, fmt.Sprintf("%s: missing field", describePath(child)))
+				}
+				continue
+			}
+			problems = append(problems, s.compare(child, want[key], value)...)
+		}
+		for _, key := range sortedKeys(got) {
+			child := joinPath(path, key)
+			if _, ok := want[key]; !ok && !s.is(s.optional, child) {
+				problems = append(problems, fmt.Sprintf("%s: unexpected field", describePath(child)))
+			}
+		}
+		return problems
+
+	case []interface{}:
+		if len(want) == 0 {
+			return nil
+		}
+		var problems []string
+		for _, value := range got.([]interface{}) {
+			problems = append(problems, s.compare(path+"[]", want[0], value)...)
+		}
+		return problems
+
+	case float64:
+		if want == math.Trunc(want) && got.(float64) != math.Trunc(got.(float64)) {
+			return []string{fmt.Sprintf("%s: got %v, want an integer", describePath(path), got)}
+		}
+
+	case string:
+		if _, err := time.Parse(time.RFC3339Nano, want); err == nil {
+			if _, err := time.Parse(time.RFC3339Nano, got.(string)); err != nil {
+				return []string{fmt.Sprintf("%s: %q is not an RFC 3339 timestamp", describePath(path), got)}
+			}
+		}
+	}
+	return nil
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func joinPath(path, key string) string {
+	if path == "" || strings.HasPrefix(path, "line ") {
+		return key
+	}
+	return path + "." + key
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "response"
+	}
+	return path
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
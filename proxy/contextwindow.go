@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ContextStrategy selects how a conversation longer than the model's context
+// window is shortened before it is sent upstream.
+type ContextStrategy string
+
+const (
+	// ContextTruncate drops the oldest turns, keeping system messages and
+	// the latest message.
+	ContextTruncate ContextStrategy = "truncate"
+	// ContextMiddleOut drops turns from the middle of the conversation,
+	// keeping its start and end, and asks OpenRouter to apply its
+	// middle-out transform should the estimate fall short.
+	ContextMiddleOut ContextStrategy = "middle-out"
+	// ContextSummarize replaces the oldest turns with a summary written by
+	// a cheap model.
+	ContextSummarize ContextStrategy = "summarize"
+)
+
+// ParseContextStrategy parses a strategy name.
+func ParseContextStrategy(name string) (ContextStrategy, error) {
+	switch strategy := ContextStrategy(name); strategy {
+	case ContextTruncate, ContextMiddleOut, ContextSummarize:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown context strategy %q, want truncate, middle-out or summarize", name)
+}
+
+// ContextConfig enables context window management.
+type ContextConfig struct {
+	Strategy ContextStrategy
+	// SummaryModel is the full OpenRouter ID of the model that writes
+	// summaries for ContextSummarize.
+	SummaryModel string
+}
+
+const (
+	// contextHeadroom is the share of the window filled with the prompt.
+	// Token counts are estimates, so some room is left for the error.
+	contextHeadroom = 0.9
+	// summaryMaxTokens caps the length of a summary.
+	summaryMaxTokens = 512
+	// summaryAuditRoute is the audit log route of summary calls.
+	summaryAuditRoute = "summary"
+)
+
+const summaryPrompt = "Summarize the following conversation between a user and an assistant. " +
+	"Keep facts, names, decisions, open questions and anything the user asked to remember. " +
+	"Write the summary as plain prose, without preamble."
+
+// errContextTooLong is returned when a request does not fit the context
+// window even with every droppable message removed.
+var errContextTooLong = errors.New("the latest message and system prompt alone exceed the context window")
+
+// contextLimit returns the number of prompt tokens a request may use: the
+// model's context length, lowered by num_ctx when the client sets one, less
+// the tokens reserved for the reply with num_predict. Zero means unknown.
+func contextLimit(model Model, options map[string]interface{}) int {
+	limit := int(model.ContextLength)
+	if numCtx, ok := optionFloat(options, "num_ctx"); ok && numCtx > 0 && (limit == 0 || int(numCtx) < limit) {
+		limit = int(numCtx)
+	}
+	if limit == 0 {
+		return 0
+	}
+	if numPredict, ok := optionFloat(options, "num_predict"); ok && numPredict > 0 {
+		limit -= int(numPredict)
+	}
+	return max(1, int(float64(limit)*contextHeadroom))
+}
+
+// fitContext shortens messages to the model's context window with the
+// configured strategy and returns them with their prompt tokens, counted once
+// here for the rate limiter and usage accounting to reuse. If the
+// conversation cannot be made to fit, it writes a 413 and returns false.
+func (s *server) fitContext(c *gin.Context, model Model, messages []openai.ChatCompletionMessage, options map[string]interface{}) ([]openai.ChatCompletionMessage, int, bool) {
+	count := func(messages []openai.ChatCompletionMessage) int {
+		return s.tokenizers.CountMessages(model.ID, messages)
+	}
+	tokens := count(messages)
+	cfg := s.contextWindow
+	if cfg == nil {
+		return messages, tokens, true
+	}
+	if cfg.Strategy == ContextMiddleOut {
+		// OpenRouter only compresses prompts that overflow, so the
+		// transform is harmless for requests that already fit.
+		ctx := withBodyFields(c.Request.Context(), map[string]interface{}{"transforms": []string{"middle-out"}})
+		c.Request = c.Request.WithContext(ctx)
+	}
+
+	limit := contextLimit(model, options)
+	if limit == 0 || tokens <= limit {
+		return messages, tokens, true
+	}
+
+	var fitted []openai.ChatCompletionMessage
+	var err error
+	switch cfg.Strategy {
+	case ContextTruncate:
+		fitted, _, err = dropOldest(messages, limit, count)
+	case ContextMiddleOut:
+		fitted, err = dropMiddle(messages, limit, count)
+	case ContextSummarize:
+		fitted, err = s.summarizeOldest(c, cfg.SummaryModel, messages, limit, count)
+	default:
+		return messages, tokens, true
+	}
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("prompt too long for %s: about %d tokens, the limit is %d: %v", model.ID, tokens, limit, err)})
+		return nil, 0, false
+	}
+
+	slog.Info("Shortened conversation to fit the context window", "model", model.ID, "strategy", cfg.Strategy,
+		"limit", limit, "estimatedTokens", tokens, "messages", len(messages), "kept", len(fitted))
+	contextShortened.WithLabelValues(string(cfg.Strategy)).Inc()
+	auditRecord(c).ContextDropped = len(messages) - len(fitted)
+	return fitted, count(fitted), true
+}
+
+// droppable returns the indexes of the messages that may be dropped, oldest
+// first: everything except system messages and the latest message.
+func droppable(messages []openai.ChatCompletionMessage) []int {
+	var indexes []int
+	for i, m := range messages[:len(messages)-1] {
+		if m.Role != openai.ChatMessageRoleSystem {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// countFunc returns the prompt tokens of messages.
+type countFunc func([]openai.ChatCompletionMessage) int
+
+// dropUntilFits removes the candidate messages in order until the rest fit
+// limit. It keeps dropping past a fit while the next kept message would be an
+// assistant or tool reply, so the conversation still opens with a user turn.
+// It returns the kept and the dropped messages.
+func dropUntilFits(messages []openai.ChatCompletionMessage, candidates []int, limit int, count countFunc) (kept, dropped []openai.ChatCompletionMessage, err error) {
+	drop := make(map[int]bool)
+	tokens := count(messages)
+	for n, i := range candidates {
+		if tokens <= limit {
+			next := messages[i]
+			if next.Role == openai.ChatMessageRoleUser || n == 0 {
+				break
+			}
+		}
+		drop[i] = true
+		tokens -= count(messages[i : i+1])
+	}
+	if tokens > limit {
+		return nil, nil, errContextTooLong
+	}
+	for i, m := range messages {
+		if drop[i] {
+			dropped = append(dropped, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	return kept, dropped, nil
+}
+
+// dropOldest drops the oldest turns until messages fit limit.
+func dropOldest(messages []openai.ChatCompletionMessage, limit int, count countFunc) (kept, dropped []openai.ChatCompletionMessage, err error) {
+	return dropUntilFits(messages, droppable(messages), limit, count)
+}
+
+// dropMiddle keeps the first turn, which usually states the task, and drops
+// the turns after it until messages fit limit.
+func dropMiddle(messages []openai.ChatCompletionMessage, limit int, count countFunc) ([]openai.ChatCompletionMessage, error) {
+	candidates := droppable(messages)
+	if len(candidates) > 1 {
+		candidates = candidates[1:]
+	}
+	kept, _, err := dropUntilFits(messages, candidates, limit, count)
+	if errors.Is(err, errContextTooLong) {
+		// The first turn alone is too long; give it up too
+		kept, _, err = dropOldest(messages, limit, count)
+	}
+	return kept, err
+}
+
+// summarizeOldest drops the oldest turns like dropOldest and puts a summary
+// of them in their place. If the summary cannot be written, the turns are
+// dropped without one.
+func (s *server) summarizeOldest(c *gin.Context, summaryModel string, messages []openai.ChatCompletionMessage, limit int, count countFunc) ([]openai.ChatCompletionMessage, error) {
+	kept, dropped, err := dropOldest(messages, limit, count)
+	if err != nil || len(dropped) == 0 {
+		return kept, err
+	}
+
+	summary, err := s.summarize(c, summaryModel, dropped)
+	if err != nil {
+		slog.Warn("Error summarizing conversation, dropping the oldest turns instead", "model", summaryModel, "Error", err)
+		return kept, nil
+	}
+
+	// Put the summary after the leading system messages
+	at := 0
+	for at < len(kept) && kept[at].Role == openai.ChatMessageRoleSystem {
+		at++
+	}
+	withSummary := make([]openai.ChatCompletionMessage, 0, len(kept)+1)
+	withSummary = append(withSummary, kept[:at]...)
+	withSummary = append(withSummary, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: "Summary of the earlier conversation: " + summary,
+	})
+	withSummary = append(withSummary, kept[at:]...)
+
+	// The summary takes room of its own, which may push out another turn
+	fitted, _, err := dropOldest(withSummary, limit, count)
+	if err != nil {
+		return kept, nil
+	}
+	return fitted, nil
+}
+
+// summarize asks summaryModel for a summary of messages. The summary is a
+// request of the client's like any other: the model must be one the client
+// may use, the call must fit its budgets and counts against its rate limits,
+// and its usage is recorded. A summary over budget fails rather than switch
+// to the budget's fallback model, so the caller drops the turns instead.
+func (s *server) summarize(c *gin.Context, summaryModel string, messages []openai.ChatCompletionMessage) (string, error) {
+	if summaryModel == "" {
+		return "", errors.New("no summary model configured")
+	}
+	model, known := s.provider.LookupModel(summaryModel)
+	if !s.allowsModel(c, model, known) {
+		return "", fmt.Errorf("summary model %s is not allowed for %s", summaryModel, clientName(c))
+	}
+	if reason := s.budgetReason(c, summaryModel, model); reason != "" {
+		return "", errors.New(reason)
+	}
+
+	// Keep the transcript within the summary model's own window, dropping
+	// its oldest lines first
+	var lines []string
+	tokenizer := s.tokenizers.For(model.ID)
+	budget := contextLimit(model, map[string]interface{}{"num_predict": float64(summaryMaxTokens)})
+	for i := len(messages) - 1; i >= 0; i-- {
+		line := messages[i].Role + ": " + messages[i].Content
+		if budget > 0 {
+			budget -= tokenizer.Count(line)
+			if budget < 0 {
+				break
+			}
+		}
+		lines = append([]string{line}, lines...)
+	}
+	if len(lines) == 0 {
+		return "", errors.New("the oldest turns are too long to summarize")
+	}
+
+	request := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: summaryPrompt},
+		{Role: openai.ChatMessageRoleUser, Content: strings.Join(lines, "\n\n")},
+	}
+	release, err := s.limiter.Acquire(clientName(c), model.ID, s.tokenizers.CountMessages(model.ID, request), false)
+	if err != nil {
+		return "", err
+	}
+	options := map[string]interface{}{"temperature": 0.0, "num_predict": float64(summaryMaxTokens)}
+	start := time.Now()
+	response, err := s.provider.Chat(c.Request.Context(), request, summaryModel, options)
+	release(response.Usage.TotalTokens)
+	s.auditSummary(c, start, summaryModel, request, options, response, err)
+	if err != nil {
+		return "", err
+	}
+	if response.Usage.TotalTokens > 0 {
+		tokensTotal.WithLabelValues(modelLabel(model.ID, known), "in").Add(float64(response.Usage.PromptTokens))
+		tokensTotal.WithLabelValues(modelLabel(model.ID, known), "out").Add(float64(response.Usage.CompletionTokens))
+		s.recordSpend(c, model, response.Usage, response.ID)
+	}
+	if len(response.Choices) == 0 || strings.TrimSpace(response.Choices[0].Message.Content) == "" {
+		return "", errors.New("empty summary")
+	}
+	return strings.TrimSpace(response.Choices[0].Message.Content), nil
+}
+
+// auditSummary writes the summary call to the audit log as a record of its
+// own, next to the record of the request that needed it.
+func (s *server) auditSummary(c *gin.Context, start time.Time, summaryModel string, request []openai.ChatCompletionMessage, options map[string]interface{}, response openai.ChatCompletionResponse, err error) {
+	if s.auditLog == nil {
+		return
+	}
+	rec := &AuditRecord{
+		Timestamp:        start.UTC(),
+		Route:            summaryAuditRoute,
+		User:             clientName(c),
+		UserAgent:        c.Request.UserAgent(),
+		RequestedModel:   summaryModel,
+		ResolvedModel:    summaryModel,
+		Options:          options,
+		MessageCount:     len(request),
+		Messages:         request,
+		PromptTokens:     response.Usage.PromptTokens,
+		CompletionTokens: response.Usage.CompletionTokens,
+		LatencyMS:        time.Since(start).Milliseconds(),
+		Status:           http.StatusOK,
+	}
+	if err != nil {
+		rec.Status = http.StatusInternalServerError
+		rec.Error = err.Error()
+	} else if len(response.Choices) > 0 {
+		rec.FinishReason = string(response.Choices[0].FinishReason)
+		rec.Response = response.Choices[0].Message.Content
+	}
+	if err := s.auditLog.Write(rec); err != nil {
+		slog.Error("Error writing audit log", "Error", err)
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// conversation returns a system prompt followed by turns alternating between
+// user and assistant, each about 25 tokens long.
+func conversation(turns int) []openai.ChatCompletionMessage {
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: "be brief"}}
+	for i := 0; i < turns; i++ {
+		role := openai.ChatMessageRoleUser
+		if i%2 == 1 {
+			role = openai.ChatMessageRoleAssistant
+		}
+		messages = append(messages, openai.ChatCompletionMessage{Role: role, Content: string(rune('a'+i)) + strings.Repeat(".", 83)})
+	}
+	return messages
+}
+
+func firstChars(messages []openai.ChatCompletionMessage) string {
+	var b strings.Builder
+	for _, m := range messages {
+		b.WriteByte(m.Content[0])
+	}
+	return b.String()
+}
+
+func TestContextLimit(t *testing.T) {
+	model := Model{ContextLength: 8192}
+	for _, tc := range []struct {
+		options map[string]interface{}
+		want    int
+	}{
+		{nil, 7372},
+		{map[string]interface{}{"num_ctx": 4096.0}, 3686},
+		{map[string]interface{}{"num_ctx": 4096.0, "num_predict": 1000.0}, 2786},
+		{map[string]interface{}{"num_ctx": 100000.0}, 7372},
+	} {
+		if got := contextLimit(model, tc.options); got != tc.want {
+			t.Errorf("contextLimit(%v) = %d, want %d", tc.options, got, tc.want)
+		}
+	}
+	if got := contextLimit(Model{}, nil); got != 0 {
+		t.Errorf("contextLimit of an unknown model = %d, want 0", got)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	messages := conversation(7) // system prompt "b" plus turns a-g, 181 tokens
+	kept, dropped, err := dropOldest(messages, 110, estimateTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dropping a-c would fit, but d is an assistant reply, so it goes too
+	if got := firstChars(kept); got != "befg" {
+		t.Errorf("kept %q, want the system prompt and the turns from e", got)
+	}
+	if got := firstChars(dropped); got != "abcd" {
+		t.Errorf("dropped %q", got)
+	}
+
+	if _, _, err := dropOldest(messages, 20, estimateTokens); err != errContextTooLong {
+		t.Errorf("err = %v, want errContextTooLong", err)
+	}
+}
+
+func TestDropMiddle(t *testing.T) {
+	kept, err := dropMiddle(conversation(7), 110, estimateTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := firstChars(kept); got != "baefg" {
+		t.Errorf("kept %q, want the system prompt, the first turn and the turns from e", got)
+	}
+}
+
+func chatRequest(messages []openai.ChatCompletionMessage, numCtx int) map[string]interface{} {
+	return map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": messages,
+		"options":  map[string]interface{}{"num_ctx": numCtx},
+	}
+}
+
+func TestChatContextTruncate(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) { o.Context = &ContextConfig{Strategy: ContextTruncate} })
+
+	// 8192 tokens of catalog context leave the request untouched
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 0)), http.StatusOK)
+	// num_ctx lowers the window
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 120)), http.StatusOK)
+
+	reqs := p.upstream.Requests()
+	if got := firstChars(reqs[0].Messages); got != "babcdefg" {
+		t.Errorf("first request sent %q", got)
+	}
+	if got := firstChars(reqs[1].Messages); got != "befg" {
+		t.Errorf("second request sent %q", got)
+	}
+
+	w := p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 20))
+	expectStatus(t, w, http.StatusRequestEntityTooLarge)
+	if msg, _ := decodeJSON(t, w)["error"].(string); !strings.Contains(msg, "exceed the context window") {
+		t.Errorf("error = %q", msg)
+	}
+}
+
+func TestChatContextMiddleOut(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) { o.Context = &ContextConfig{Strategy: ContextMiddleOut} })
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 120)), http.StatusOK)
+
+	if got := firstChars(p.upstream.Requests()[0].Messages); got != "baefg" {
+		t.Errorf("sent %q", got)
+	}
+	var transforms []string
+	json.Unmarshal(p.upstream.Bodies()[0]["transforms"], &transforms)
+	if len(transforms) != 1 || transforms[0] != "middle-out" {
+		t.Errorf("transforms = %v", transforms)
+	}
+}
+
+func TestChatContextSummarize(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) {
+		o.Context = &ContextConfig{Strategy: ContextSummarize, SummaryModel: "openai/gpt-4o-mini"}
+	})
+	p.upstream.Script(fakeResponse{Chunks: []string{"They counted letters."}}, fakeResponse{Chunks: []string{"h"}})
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 150)), http.StatusOK)
+
+	reqs := p.upstream.Requests()
+	if len(reqs) != 2 || reqs[0].Model != "openai/gpt-4o-mini" {
+		t.Fatalf("expected a summary request first, got %+v", reqs)
+	}
+	if transcript := reqs[0].Messages[1].Content; !strings.HasPrefix(transcript, "user: a") {
+		t.Errorf("summary transcript = %q", transcript)
+	}
+	sent := reqs[1].Messages
+	if len(sent) < 3 || sent[1].Role != openai.ChatMessageRoleSystem || !strings.Contains(sent[1].Content, "They counted letters.") {
+		t.Fatalf("summary not sent: %+v", sent)
+	}
+	if last := sent[len(sent)-1].Content; last[0] != 'g' {
+		t.Errorf("latest turn not kept: %+v", sent)
+	}
+}
+
+func TestChatContextSummarizeFallsBack(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) {
+		o.Context = &ContextConfig{Strategy: ContextSummarize, SummaryModel: "openai/gpt-4o-mini"}
+	})
+	p.upstream.Script(fakeResponse{Status: http.StatusInternalServerError})
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 120)), http.StatusOK)
+
+	reqs := p.upstream.Requests()
+	if got := firstChars(reqs[len(reqs)-1].Messages); got != "befg" {
+		t.Errorf("sent %q, want the oldest turns dropped", got)
+	}
+}
+
+func TestChatContextSummaryModelAllowlist(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(tokensFile, []byte(`[{"token": "user-token", "user": "alice", "models": ["openai/gpt-4o"]}]`), 0o600)
+	tokens, err := LoadTokenStore(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, func(o *Options) {
+		o.Tokens = tokens
+		o.Context = &ContextConfig{Strategy: ContextSummarize, SummaryModel: "openai/gpt-4o-mini"}
+	})
+
+	data, _ := json.Marshal(chatRequest(conversation(7), 120))
+	req := httptest.NewRequest(http.MethodPost, "/api/chat", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer user-token")
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	expectStatus(t, w, http.StatusOK)
+
+	// alice may not use the summary model, so the turns are dropped instead
+	reqs := p.upstream.Requests()
+	if len(reqs) != 1 || reqs[0].Model != "openai/gpt-4o" {
+		t.Fatalf("upstream requests = %d, want only the chat", len(reqs))
+	}
+	if got := firstChars(reqs[0].Messages); got != "befg" {
+		t.Errorf("sent %q, want the oldest turns dropped", got)
+	}
+}
+
+func TestChatContextSummaryOverBudget(t *testing.T) {
+	spend := openTestSpendStore(t)
+	spend.Record("127.0.0.1", "openai/gpt-4o", openai.Usage{PromptTokens: 10, TotalTokens: 10}, 2, false)
+	p := newTestProxy(t, func(o *Options) {
+		o.Spend = spend
+		o.Budgets = &Budgets{DefaultUser: Budget{DailyUSD: 1}, FallbackModel: "mistralai/mistral-7b-instruct:free"}
+		o.Context = &ContextConfig{Strategy: ContextSummarize, SummaryModel: "openai/gpt-4o-mini"}
+	})
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 120)), http.StatusOK)
+
+	// The chat goes to the fallback, but the summary is not paid for
+	reqs := p.upstream.Requests()
+	if len(reqs) != 1 || reqs[0].Model != "mistralai/mistral-7b-instruct:free" {
+		t.Fatalf("upstream requests = %d, want only the fallback chat", len(reqs))
+	}
+	if got := firstChars(reqs[0].Messages); got != "befg" {
+		t.Errorf("sent %q, want the oldest turns dropped", got)
+	}
+}
+
+func TestChatContextSummaryRateLimited(t *testing.T) {
+	limiter, _ := newTestLimiter(t, `{"models": {"openai/gpt-4o-mini": {"requests_per_minute": 1}}}`)
+	p := newTestProxy(t, func(o *Options) {
+		o.Limiter = limiter
+		o.Context = &ContextConfig{Strategy: ContextSummarize, SummaryModel: "openai/gpt-4o-mini"}
+	})
+	p.upstream.Script(fakeResponse{Chunks: []string{"They counted letters."}})
+
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 120)), http.StatusOK)
+	if reqs := p.upstream.Requests(); len(reqs) != 2 || reqs[0].Model != "openai/gpt-4o-mini" {
+		t.Fatalf("expected a summary request first, got %d requests", len(reqs))
+	}
+
+	// The summary used up the model's limit, so the next one is skipped
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chatRequest(conversation(7), 120)), http.StatusOK)
+	reqs := p.upstream.Requests()
+	if len(reqs) != 3 || reqs[2].Model != "openai/gpt-4o" {
+		t.Fatalf("upstream requests = %d, want no second summary", len(reqs))
+	}
+	if got := firstChars(reqs[2].Messages); got != "befg" {
+		t.Errorf("sent %q, want the oldest turns dropped", got)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig controls which web pages may call the proxy from a browser.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed to make requests, such as
+	// "https://app.example.com". A "*" matches any run of characters, so
+	// "https://*.example.com" allows every subdomain and "http://localhost:*"
+	// every port. A lone "*" allows every origin.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+// DefaultCORSOrigins are the origins Ollama allows when OLLAMA_ORIGINS is
+// unset: pages served from the local machine and desktop app webviews.
+var DefaultCORSOrigins = defaultCORSOrigins()
+
+func defaultCORSOrigins() []string {
+	var origins []string
+	for _, host := range []string{"localhost", "127.0.0.1", "0.0.0.0", "[::1]"} {
+		origins = append(origins,
+			"http://"+host,
+			"https://"+host,
+			"http://"+host+":*",
+			"https://"+host+":*",
+		)
+	}
+	return append(origins, "app://*", "file://*", "tauri://*", "vscode-webview://*", "vscode-file://*")
+}
+
+// DefaultCORSConfig allows the DefaultCORSOrigins with the methods and
+// headers Ollama clients use.
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedOrigins: append([]string(nil), DefaultCORSOrigins...),
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "User-Agent", "Accept", "X-Requested-With"},
+		MaxAge:         12 * time.Hour,
+	}
+}
+
+// allowsOrigin reports whether origin matches one of the allowed patterns.
+func (cfg CORSConfig) allowsOrigin(origin string) bool {
+	for _, pattern := range cfg.AllowedOrigins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches origin against pattern, where each "*" in the pattern
+// stands for any run of characters. Matching is case insensitive, as the
+// scheme and host of an origin are.
+func matchOrigin(pattern, origin string) bool {
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == origin
+	}
+	if !strings.HasPrefix(origin, parts[0]) {
+		return false
+	}
+	origin = origin[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(origin, part)
+		if i < 0 {
+			return false
+		}
+		origin = origin[i+len(part):]
+	}
+	return strings.HasSuffix(origin, last)
+}
+
+// corsMiddleware applies cfg. Requests from origins that are not allowed
+// get a 403; requests without an Origin header, which browsers always send
+// cross origin, pass through unchanged.
+func corsMiddleware(cfg CORSConfig) gin.HandlerFunc {
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if !cfg.allowsOrigin(origin) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed: " + origin})
+			return
+		}
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Writer.Header().Add("Vary", "Origin")
+		if cfg.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		if c.Request.Method == http.MethodOptions {
+			c.Header("Access-Control-Allow-Methods", methods)
+			c.Header("Access-Control-Allow-Headers", headers)
+			if cfg.MaxAge > 0 {
+				c.Header("Access-Control-Max-Age", maxAge)
+			}
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
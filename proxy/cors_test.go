@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"*", "https://anything.example", true},
+		{"http://localhost", "http://localhost", true},
+		{"http://localhost", "http://localhost:8080", false},
+		{"http://localhost:*", "http://localhost:8080", true},
+		{"http://localhost:*", "http://localhost.evil.com", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://example.com.evil.net", false},
+		{"https://*.example.com", "http://app.example.com", false},
+		{"HTTPS://App.Example.com", "https://app.example.com", true},
+		{"app://*", "app://obsidian.md", true},
+	} {
+		if got := matchOrigin(tc.pattern, tc.origin); got != tc.want {
+			t.Errorf("matchOrigin(%q, %q) = %v, want %v", tc.pattern, tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	cors := DefaultCORSConfig()
+	cors.AllowedOrigins = append(cors.AllowedOrigins, "https://*.example.com")
+	cors.AllowCredentials = true
+	p := newTestProxy(t, func(o *Options) { o.CORS = &cors })
+
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/version", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		p.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodGet, "https://evil.test")
+	expectStatus(t, w, http.StatusForbidden)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("disallowed origin got Access-Control-Allow-Origin")
+	}
+
+	w = request(http.MethodGet, "https://chat.example.com")
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://chat.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q", got)
+	}
+
+	w = request(http.MethodOptions, "http://127.0.0.1:5173")
+	expectStatus(t, w, http.StatusNoContent)
+	if w.Header().Get("Access-Control-Allow-Methods") == "" || w.Header().Get("Access-Control-Max-Age") != "43200" {
+		t.Errorf("unexpected preflight headers: %v", w.Header())
+	}
+
+	// Clients outside a browser send no Origin and are unaffected
+	w = request(http.MethodGet, "")
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("request without Origin got CORS headers")
+	}
+}
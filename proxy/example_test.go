@@ -0,0 +1,29 @@
+package proxy_test
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"ollama-to-openrouter-proxy/proxy"
+)
+
+// Mount the Ollama API in an existing service, restricted to free models.
+func ExampleNew() {
+	keys, err := proxy.ParseKeyPool(os.Getenv("OPENROUTER_API_KEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	filter, err := proxy.ParseModelFilter(strings.NewReader("price:free"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	provider := proxy.NewOpenrouterProvider(keys, "")
+	ollama := proxy.New(provider, filter, proxy.Options{EnforceAllowlist: true})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", ollama)
+	log.Fatal(http.ListenAndServe(":11434", mux))
+}
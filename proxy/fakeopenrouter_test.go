@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeResponse scripts one answer of the fake /chat/completions endpoint.
+type fakeResponse struct {
+	// Status, when set, fails the call with this HTTP status.
+	Status int
+	// Chunks are the content deltas of a stream; non-streaming requests get
+	// them joined.
+	Chunks []string
+	// Delay is waited before each chunk.
+	Delay time.Duration
+	// FailAfter breaks a stream with an error after this many chunks.
+	FailAfter int
+	// FinishReason defaults to "stop".
+	FinishReason string
+	// Usage defaults to 10 prompt tokens and one completion token per chunk.
+	Usage *openai.Usage
+}
+
+// fakeOpenRouter is an in-process stand-in for the OpenRouter API. It serves
+// /models, /key, /generation and /chat/completions, answering chat calls from
+// a script.
+type fakeOpenRouter struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	models   []string
+	script   []fakeResponse
+	requests []openai.ChatCompletionRequest
+	bodies   []map[string]json.RawMessage
+	keys     []string
+	// keyStatus, when set, fails /key with this HTTP status.
+	keyStatus int
+	// keyCredit is the remaining credit /key reports per key; keys without
+	// an entry have no limit.
+	keyCredit map[string]float64
+	// generationCost is what /generation reports; generationStatus, when
+	// set, fails it instead.
+	generationCost   float64
+	generationStatus int
+}
+
+// defaultFakeModels is the catalog served unless a test passes its own.
+var defaultFakeModels = []string{"openai/gpt-4o", "openai/gpt-4o-mini", "meta-llama/llama-3-70b-instruct", "mistralai/mistral-7b-instruct:free", "openrouter/auto"}
+
+func newFakeOpenRouter(t *testing.T, models ...string) *fakeOpenRouter {
+	t.Helper()
+	if len(models) == 0 {
+		models = defaultFakeModels
+	}
+	f := &fakeOpenRouter{models: models}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /models", f.handleModels)
+	mux.HandleFunc("GET /key", f.handleKey)
+	mux.HandleFunc("GET /generation", f.handleGeneration)
+	mux.HandleFunc("POST /chat/completions", f.handleChat)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Script queues responses for the next chat calls. Once the queue is empty
+// calls are answered with "Hello world".
+func (f *fakeOpenRouter) Script(responses ...fakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append(f.script, responses...)
+}
+
+// Requests returns the chat requests received so far.
+func (f *fakeOpenRouter) Requests() []openai.ChatCompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]openai.ChatCompletionRequest(nil), f.requests...)
+}
+
+// Bodies returns the raw JSON fields of each chat request, including those
+// go-openai has no field for.
+func (f *fakeOpenRouter) Bodies() []map[string]json.RawMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]json.RawMessage(nil), f.bodies...)
+}
+
+// Keys returns the API key used by each chat request.
+func (f *fakeOpenRouter) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.keys...)
+}
+
+// FailKey makes /key answer with status, as OpenRouter does for a revoked
+// key.
+func (f *fakeOpenRouter) FailKey(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keyStatus = status
+}
+
+// SetKeyCredit sets the credit /key reports as remaining for key.
+func (f *fakeOpenRouter) SetKeyCredit(key string, remaining float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.keyCredit == nil {
+		f.keyCredit = make(map[string]float64)
+	}
+	f.keyCredit[key] = remaining
+}
+
+// SetGeneration sets the cost /generation reports for every generation, or
+// makes it fail with status when that is not zero.
+func (f *fakeOpenRouter) SetGeneration(cost float64, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.generationCost = cost
+	f.generationStatus = status
+}
+
+func (f *fakeOpenRouter) next() fakeResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.script) == 0 {
+		return fakeResponse{Chunks: []string{"Hello", " world"}}
+	}
+	resp := f.script[0]
+	f.script = f.script[1:]
+	return resp
+}
+
+func (f *fakeOpenRouter) handleModels(w http.ResponseWriter, r *http.Request) {
+	data := make([]map[string]interface{}, 0, len(f.models))
+	for _, id := range f.models {
+		price := "0.000001"
+		switch {
+		case strings.HasSuffix(id, ":free"):
+			price = "0"
+		case strings.HasPrefix(id, "openrouter/"):
+			price = "-1" // Variable-priced router
+		}
+		data = append(data, map[string]interface{}{
+			"id":             id,
+			"context_length": 8192,
+			"pricing":        map[string]string{"prompt": price, "completion": price},
+		})
+	}
+	writeFakeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+}
+
+func (f *fakeOpenRouter) handleKey(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	status := f.keyStatus
+	remaining, limited := f.keyCredit[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	f.mu.Unlock()
+	if status != 0 {
+		writeFakeError(w, status, http.StatusText(status))
+		return
+	}
+	info := map[string]interface{}{"usage": 0, "limit": nil, "limit_remaining": nil}
+	if limited {
+		info["limit"] = 10
+		info["limit_remaining"] = remaining
+	}
+	writeFakeJSON(w, http.StatusOK, map[string]interface{}{"data": info})
+}
+
+func (f *fakeOpenRouter) handleGeneration(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	cost, status := f.generationCost, f.generationStatus
+	f.mu.Unlock()
+	if status != 0 {
+		writeFakeError(w, status, http.StatusText(status))
+		return
+	}
+	writeFakeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{"id": r.URL.Query().Get("id"), "total_cost": cost},
+	})
+}
+
+func (f *fakeOpenRouter) handleChat(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req openai.ChatCompletionRequest
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data, &req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	json.Unmarshal(data, &body)
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.bodies = append(f.bodies, body)
+	f.keys = append(f.keys, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	f.mu.Unlock()
+
+	resp := f.next()
+	if resp.Status != 0 {
+		writeFakeError(w, resp.Status, http.StatusText(resp.Status))
+		return
+	}
+	if resp.FinishReason == "" {
+		resp.FinishReason = "stop"
+	}
+	usage := resp.Usage
+	if usage == nil {
+		usage = &openai.Usage{PromptTokens: 10, CompletionTokens: len(resp.Chunks)}
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+
+	if !req.Stream {
+		for range resp.Chunks {
+			if !fakeDelay(r, resp.Delay) {
+				return
+			}
+		}
+		writeFakeJSON(w, http.StatusOK, openai.ChatCompletionResponse{
+			ID:     "gen-fake",
+			Object: "chat.completion",
+			Model:  req.Model,
+			Choices: []openai.ChatCompletionChoice{{
+				Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: strings.Join(resp.Chunks, "")},
+				FinishReason: openai.FinishReason(resp.FinishReason),
+			}},
+			Usage: *usage,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher := w.(http.Flusher)
+	event := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+	chunk := func(content, finishReason string) openai.ChatCompletionStreamResponse {
+		return openai.ChatCompletionStreamResponse{
+			ID:     "gen-fake",
+			Object: "chat.completion.chunk",
+			Model:  req.Model,
+			Choices: []openai.ChatCompletionStreamChoice{{
+				Delta:        openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant, Content: content},
+				FinishReason: openai.FinishReason(finishReason),
+			}},
+		}
+	}
+
+	for i, content := range resp.Chunks {
+		if resp.FailAfter > 0 && i == resp.FailAfter {
+			// go-openai reports a stream error for a payload without the
+			// "data:" prefix.
+			fmt.Fprintf(w, `{"error":{"message":"upstream failed mid-stream","code":502}}`+"\n")
+			return
+		}
+		if !fakeDelay(r, resp.Delay) {
+			return
+		}
+		event(chunk(content, ""))
+	}
+	event(chunk("", resp.FinishReason))
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		event(openai.ChatCompletionStreamResponse{ID: "gen-fake", Model: req.Model, Choices: []openai.ChatCompletionStreamChoice{}, Usage: usage})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// fakeDelay waits for d unless the request is cancelled first.
+func fakeDelay(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeFakeError(w http.ResponseWriter, status int, message string) {
+	writeFakeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "code": status},
+	})
+}
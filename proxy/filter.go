@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ModelFilter decides which catalog models the proxy exposes. It is built
+// from a models-filter file where each non-empty line is a rule:
+//
+//	deepseek-chat-v3-0324:free   exact short name or full ID
+//	google/*                     glob, matched against full ID and short name
+//	re:^anthropic/claude-3       regular expression
+//	vendor:mistralai             vendor prefix of the full ID (globs allowed)
+//	price:free                   only models with zero prompt/completion price
+//	max_price:1.5                prompt price at most 1.5 USD per 1M tokens
+//	min_context:100000           context length of at least 100000 tokens
+//	!openai/*                    a leading "!" turns any rule into an exclude
+//
+// Lines starting with "#" are comments. A model is allowed when it matches
+// at least one include rule (or there are none) and no exclude rule. Price
+// rules never match models whose price is unknown or variable, such as
+// openrouter/auto or models missing from the catalog.
+type ModelFilter struct {
+	includes []filterRule
+	excludes []filterRule
+}
+
+type filterRule struct {
+	source string
+	match  func(Model) bool
+}
+
+// Empty reports whether the filter has no rules and allows every model.
+func (f *ModelFilter) Empty() bool {
+	return f == nil || (len(f.includes) == 0 && len(f.excludes) == 0)
+}
+
+// Filter returns f itself, so a fixed filter can be used as a FilterSource.
+func (f *ModelFilter) Filter() *ModelFilter {
+	return f
+}
+
+// Allows reports whether the model passes the filter.
+func (f *ModelFilter) Allows(m Model) bool {
+	if f.Empty() {
+		return true
+	}
+	for _, rule := range f.excludes {
+		if rule.match(m) {
+			return false
+		}
+	}
+	if len(f.includes) == 0 {
+		return true
+	}
+	for _, rule := range f.includes {
+		if rule.match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules returns the source lines of all rules, includes first.
+func (f *ModelFilter) Rules() []string {
+	if f == nil {
+		return nil
+	}
+	rules := make([]string, 0, len(f.includes)+len(f.excludes))
+	for _, rule := range f.includes {
+		rules = append(rules, rule.source)
+	}
+	for _, rule := range f.excludes {
+		rules = append(rules, "!"+rule.source)
+	}
+	return rules
+}
+
+// ParseModelFilter reads filter rules from r.
+func ParseModelFilter(r io.Reader) (*ModelFilter, error) {
+	filter := &ModelFilter{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		exclude := strings.HasPrefix(line, "!")
+		if exclude {
+			line = strings.TrimSpace(line[1:])
+		}
+
+		match, err := parseFilterRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		rule := filterRule{source: line, match: match}
+		if exclude {
+			filter.excludes = append(filter.excludes, rule)
+		} else {
+			filter.includes = append(filter.includes, rule)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+func parseFilterRule(rule string) (func(Model) bool, error) {
+	key, value, _ := strings.Cut(rule, ":")
+	switch key {
+	case "re":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", value, err)
+		}
+		return func(m Model) bool {
+			return re.MatchString(m.ID) || re.MatchString(m.Name)
+		}, nil
+	case "vendor":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid vendor pattern %q: %w", value, err)
+		}
+		return func(m Model) bool {
+			vendor, _, found := strings.Cut(m.ID, "/")
+			if !found {
+				return false
+			}
+			ok, _ := path.Match(value, vendor)
+			return ok
+		}, nil
+	case "price":
+		if value != "free" {
+			return nil, fmt.Errorf("unsupported price rule %q, expected price:free", value)
+		}
+		return func(m Model) bool {
+			return m.Pricing.IsFree()
+		}, nil
+	case "max_price":
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_price %q: %w", value, err)
+		}
+		return func(m Model) bool {
+			return m.Pricing.Known && m.Pricing.Prompt*1_000_000 <= limit
+		}, nil
+	case "min_context":
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min_context %q: %w", value, err)
+		}
+		return func(m Model) bool {
+			return m.ContextLength >= limit
+		}, nil
+	}
+
+	// Anything else is a glob; plain names are globs without wildcards, so
+	// filter files from older versions keep working.
+	if _, err := path.Match(rule, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", rule, err)
+	}
+	return func(m Model) bool {
+		if ok, _ := path.Match(rule, m.ID); ok {
+			return true
+		}
+		ok, _ := path.Match(rule, m.Name)
+		return ok
+	}, nil
+}
+
+func loadModelFilter(filePath string) (*ModelFilter, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseModelFilter(file)
+}
+
+// FilterStore holds the active model filter and reloads it when the file
+// changes on disk or the process receives SIGHUP.
+type FilterStore struct {
+	path    string
+	current atomic.Pointer[ModelFilter]
+	modTime time.Time
+}
+
+func NewFilterStore(filePath string) *FilterStore {
+	s := &FilterStore{path: filePath}
+	s.current.Store(&ModelFilter{})
+	return s
+}
+
+// Filter returns the currently active filter.
+func (s *FilterStore) Filter() *ModelFilter {
+	return s.current.Load()
+}
+
+// Reload reads the filter file again. A missing file disables filtering; a
+// malformed file keeps the previous filter in place.
+func (s *FilterStore) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.modTime = time.Time{}
+			s.current.Store(&ModelFilter{})
+		}
+		return err
+	}
+
+	s.modTime = info.ModTime()
+	filter, err := loadModelFilter(s.path)
+	if err != nil {
+		return err
+	}
+	s.current.Store(filter)
+	return nil
+}
+
+// Watch reloads the filter on SIGHUP and whenever the file's modification
+// time changes, checking every interval. Polling is deliberate: it needs no
+// dependency beyond the standard library, and unlike inotify watches it
+// follows files replaced by rename, as editors and ConfigMap updates do.
+func (s *FilterStore) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hup:
+				slog.Info("SIGHUP received, reloading models filter")
+			case <-ticker.C:
+				info, err := os.Stat(s.path)
+				if err == nil && info.ModTime().Equal(s.modTime) {
+					continue
+				}
+				if err != nil && s.modTime.IsZero() {
+					continue
+				}
+			}
+			s.reloadAndLog()
+		}
+	}()
+}
+
+func (s *FilterStore) reloadAndLog() {
+	s.LogReload(s.Reload())
+}
+
+// LogReload reports the outcome of a Reload call.
+func (s *FilterStore) LogReload(err error) {
+	if err != nil {
+		if os.IsNotExist(err) {
+			slog.Info("models-filter file not found. Skipping model filtering.")
+			return
+		}
+		slog.Error("Error loading models filter", "Error", err)
+		return
+	}
+	if s.Filter().Empty() {
+		slog.Info("models-filter is empty. Skipping model filtering.")
+		return
+	}
+	slog.Info("Loaded models from filter:")
+	for _, rule := range s.Filter().Rules() {
+		slog.Info(" - " + rule)
+	}
+}
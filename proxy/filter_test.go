@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// filterModel returns a catalog model with the given ID, prompt price in USD
+// per million tokens and context length.
+func filterModel(id string, pricePerMillion float64, contextLength int64) Model {
+	return Model{
+		ID:            id,
+		Name:          shortModelName(id),
+		ContextLength: contextLength,
+		Pricing:       ModelPricing{Prompt: pricePerMillion / 1_000_000, Completion: pricePerMillion / 1_000_000, Known: true},
+	}
+}
+
+func TestParseModelFilter(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		rules  []string
+		err    string
+	}{
+		{"", []string{}, ""},
+		{"# comment\n\n  gpt-4o  \n", []string{"gpt-4o"}, ""},
+		{"!openai/*\nvendor:google", []string{"vendor:google", "!openai/*"}, ""},
+		{"! price:free", []string{"!price:free"}, ""},
+		{"re:(", nil, "line 1: invalid regex"},
+		{"ok\nprice:cheap", nil, "line 2: unsupported price rule"},
+		{"max_price:abc", nil, "invalid max_price"},
+		{"min_context:1.5", nil, "invalid min_context"},
+		{"vendor:[", nil, "invalid vendor pattern"},
+		{"openai/[", nil, "invalid pattern"},
+	} {
+		filter, err := ParseModelFilter(strings.NewReader(tc.source))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("ParseModelFilter(%q) error = %v, want %q", tc.source, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseModelFilter(%q): %v", tc.source, err)
+			continue
+		}
+		if got := filter.Rules(); !reflect.DeepEqual(got, tc.rules) {
+			t.Errorf("ParseModelFilter(%q) rules = %q, want %q", tc.source, got, tc.rules)
+		}
+	}
+}
+
+func TestModelFilterAllows(t *testing.T) {
+	gpt4o := filterModel("openai/gpt-4o", 2.5, 128000)
+	mini := filterModel("openai/gpt-4o-mini", 0.15, 128000)
+	gemini := filterModel("google/gemini-pro-1.5", 1.25, 2000000)
+	mistral := filterModel("mistralai/mistral-7b-instruct:free", 0, 32768)
+	claude := filterModel("anthropic/claude-3-opus", 15, 200000)
+	// Models missing from the catalog have unknown pricing and no context
+	unknown, _ := NewOpenrouterProvider(&KeyPool{}, "").LookupModel("vendor/unlisted")
+
+	for _, tc := range []struct {
+		rules string
+		model Model
+		want  bool
+	}{
+		{"", unknown, true},
+		{"gpt-4o", gpt4o, true},
+		{"gpt-4o", mini, false},
+		{"openai/gpt-4o", gpt4o, true},
+		{"mistral-7b-instruct:free", mistral, true},
+		{"openai/*", mini, true},
+		{"*gemini*", gemini, true},
+		{"*gemini*", gpt4o, false},
+		{"re:^anthropic/claude-3", claude, true},
+		{"re:^claude", claude, true}, // Matches the short name
+		{"re:^anthropic/claude-2", claude, false},
+		{"vendor:mistralai", mistral, true},
+		{"vendor:open*", gpt4o, true},
+		{"vendor:openai", unknown, false},
+		{"price:free", mistral, true},
+		{"price:free", mini, false},
+		{"price:free", unknown, false},
+		{"max_price:1.5", gemini, true},
+		{"max_price:1.5", gpt4o, false},
+		{"max_price:1.5", unknown, false},
+		{"min_context:1000000", gemini, true},
+		{"min_context:1000000", claude, false},
+		{"min_context:1", unknown, false},
+		// Exclusions win over includes
+		{"openai/*\n!*mini*", mini, false},
+		{"openai/*\n!*mini*", gpt4o, true},
+		{"!price:free", mistral, false},
+		{"!price:free", unknown, true},
+		// With only exclusions, everything else is allowed
+		{"!openai/*", gemini, true},
+		{"!openai/*", unknown, true},
+		// Any include rule is enough
+		{"vendor:google\nmax_price:0.2", mini, true},
+		{"vendor:google\nmax_price:0.2", claude, false},
+		{"vendor:google\nmax_price:0.2", unknown, false},
+	} {
+		filter, err := ParseModelFilter(strings.NewReader(tc.rules))
+		if err != nil {
+			t.Fatalf("ParseModelFilter(%q): %v", tc.rules, err)
+		}
+		if got := filter.Allows(tc.model); got != tc.want {
+			t.Errorf("rules %q allow %s = %v, want %v", tc.rules, tc.model.ID, got, tc.want)
+		}
+	}
+}
+
+func TestFilterStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models-filter")
+	store := NewFilterStore(path)
+	if err := store.Reload(); !os.IsNotExist(err) || !store.Filter().Empty() {
+		t.Fatalf("missing file: err = %v, empty = %v", err, store.Filter().Empty())
+	}
+
+	os.WriteFile(path, []byte("openai/*\n"), 0o600)
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.Filter().Rules(); !reflect.DeepEqual(got, []string{"openai/*"}) {
+		t.Errorf("rules = %q", got)
+	}
+
+	// A malformed file keeps the previous filter
+	os.WriteFile(path, []byte("re:(\n"), 0o600)
+	if err := store.Reload(); err == nil {
+		t.Error("malformed file loaded")
+	}
+	if got := store.Filter().Rules(); !reflect.DeepEqual(got, []string{"openai/*"}) {
+		t.Errorf("rules after a malformed reload = %q", got)
+	}
+
+	// Watch picks up a change of the modification time
+	os.WriteFile(path, []byte("vendor:google\n"), 0o600)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+	store.Watch(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(store.Filter().Rules(), []string{"vendor:google"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("watch did not reload, rules = %q", store.Filter().Rules())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPriceRulesSkipVariablePricing(t *testing.T) {
+	upstream := newFakeOpenRouter(t, "openrouter/auto", "mistralai/mistral-7b-instruct:free", "openai/gpt-4o")
+	keys, err := ParseKeyPool("sk-or-test-key-0000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewOpenrouterProvider(keys, upstream.URL)
+	if _, err := provider.GetModels(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	router, _ := provider.LookupModel("openrouter/auto")
+	if router.Pricing.Known {
+		t.Errorf("openrouter/auto pricing = %+v, want unknown", router.Pricing)
+	}
+	unlisted, _ := provider.LookupModel("vendor/unlisted")
+	free, _ := provider.LookupModel("mistralai/mistral-7b-instruct:free")
+
+	for _, rule := range []string{"price:free", "max_price:1.5"} {
+		filter, err := ParseModelFilter(strings.NewReader(rule))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filter.Allows(router) {
+			t.Errorf("%s allows the variable-priced router", rule)
+		}
+		if filter.Allows(unlisted) {
+			t.Errorf("%s allows a model missing from the catalog", rule)
+		}
+		if !filter.Allows(free) {
+			t.Errorf("%s rejects a free model", rule)
+		}
+	}
+}
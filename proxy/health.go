@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultReadyTimeout  = 5 * time.Second
+	defaultReadyCacheTTL = 10 * time.Second
+)
+
+// readinessCheck is the outcome of one readiness check.
+type readinessCheck struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	// Models is the catalog size, for the catalog check.
+	Models int `json:"models,omitempty"`
+	// UsableKeys and Keys count the pool keys, for the key check.
+	UsableKeys int `json:"usable_keys,omitempty"`
+	Keys       int `json:"keys,omitempty"`
+}
+
+// readiness is the /readyz response body.
+type readiness struct {
+	Status    string                    `json:"status"`
+	CheckedAt time.Time                 `json:"checked_at"`
+	Checks    map[string]readinessCheck `json:"checks"`
+}
+
+func (r readiness) ready() bool {
+	for _, check := range r.Checks {
+		if !check.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// readinessProbe checks that the upstream is usable and caches the result,
+// so frequent probes from an orchestrator do not each call OpenRouter.
+type readinessProbe struct {
+	provider *OpenrouterProvider
+	timeout  time.Duration
+	ttl      time.Duration
+
+	mu   sync.Mutex
+	last *readiness
+}
+
+// check returns the cached result while it is fresh and runs the checks
+// otherwise. Concurrent callers wait for a single run.
+func (p *readinessProbe) check(ctx context.Context) readiness {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last != nil && time.Since(p.last.CheckedAt) < p.ttl {
+		return *p.last
+	}
+
+	// Callers share the result, so one going away must not fail the run
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.timeout)
+	defer cancel()
+
+	result := readiness{
+		CheckedAt: time.Now(),
+		Checks: map[string]readinessCheck{
+			"catalog": p.checkCatalog(ctx),
+			"key":     p.checkKeys(ctx),
+		},
+	}
+	result.Status = "ready"
+	if !result.ready() {
+		result.Status = "not ready"
+	}
+	p.last = &result
+	return result
+}
+
+// checkCatalog fetches the model catalog, which also proves OpenRouter is
+// reachable.
+func (p *readinessProbe) checkCatalog(ctx context.Context) readinessCheck {
+	start := time.Now()
+	models, err := p.provider.GetModels(ctx)
+	check := readinessCheck{LatencyMS: time.Since(start).Milliseconds(), Models: len(models)}
+	switch {
+	case err != nil:
+		check.Error = err.Error()
+	case len(models) == 0:
+		check.Error = "catalog is empty"
+	default:
+		check.OK = true
+	}
+	return check
+}
+
+// checkKeys asks OpenRouter whether the pool keys are valid and have credit
+// left. One usable key is enough.
+func (p *readinessProbe) checkKeys(ctx context.Context) readinessCheck {
+	start := time.Now()
+	usable, err := p.provider.RefreshKeyCredits(ctx)
+	check := readinessCheck{
+		OK:         usable > 0,
+		LatencyMS:  time.Since(start).Milliseconds(),
+		UsableKeys: usable,
+		Keys:       p.provider.keys.Len(),
+	}
+	if !check.OK {
+		check.Error = "no usable OpenRouter key"
+		if err != nil {
+			check.Error += ": " + err.Error()
+		}
+	}
+	return check
+}
+
+// handleHealth reports that the process is up, without checking upstream.
+func (s *server) handleHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleReady reports whether the proxy can serve requests: the catalog
+// loads, a key is valid and OpenRouter answers within the timeout.
+func (s *server) handleReady(c *gin.Context) {
+	result := s.readiness.check(c.Request.Context())
+	status := http.StatusOK
+	if !result.ready() {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, result)
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.Close()
+	w := p.do(t, http.MethodGet, "/healthz", nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := decodeJSON(t, w); body["status"] != "ok" {
+		t.Errorf("unexpected body: %v", body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	p := newTestProxy(t)
+	w := p.do(t, http.MethodGet, "/readyz", nil)
+	expectStatus(t, w, http.StatusOK)
+	body := decodeJSON(t, w)
+	checks := body["checks"].(map[string]interface{})
+	catalog := checks["catalog"].(map[string]interface{})
+	key := checks["key"].(map[string]interface{})
+	if body["status"] != "ready" || catalog["models"] != float64(len(defaultFakeModels)) || key["usable_keys"] != 1.0 {
+		t.Errorf("unexpected body: %v", body)
+	}
+
+	// The result is cached, so an outage shows up only once it expires
+	p.upstream.Close()
+	expectStatus(t, p.do(t, http.MethodGet, "/readyz", nil), http.StatusOK)
+	p.router.s.readiness.last.CheckedAt = time.Now().Add(-time.Hour)
+	w = p.do(t, http.MethodGet, "/readyz", nil)
+	expectStatus(t, w, http.StatusServiceUnavailable)
+	body = decodeJSON(t, w)
+	catalog = body["checks"].(map[string]interface{})["catalog"].(map[string]interface{})
+	if body["status"] != "not ready" || catalog["ok"] != false || catalog["error"] == "" {
+		t.Errorf("unexpected body: %v", body)
+	}
+}
+
+func TestReadyzInvalidKey(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.FailKey(http.StatusUnauthorized)
+	w := p.do(t, http.MethodGet, "/readyz", nil)
+	expectStatus(t, w, http.StatusServiceUnavailable)
+	key := decodeJSON(t, w)["checks"].(map[string]interface{})["key"].(map[string]interface{})
+	if msg, _ := key["error"].(string); key["ok"] != false || !strings.Contains(msg, "401") {
+		t.Errorf("unexpected key check: %v", key)
+	}
+}
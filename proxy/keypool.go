@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// How long a key is taken out of rotation after OpenRouter rejects it.
+const (
+	benchUnauthorized = time.Hour        // 401: revoked or mistyped key
+	benchNoCredit     = 30 * time.Minute // 402: credit limit reached
+	benchRateLimited  = time.Minute      // 429: rate limited
+)
+
+// ErrNoAvailableKeys is returned when every key in the pool is benched.
+var ErrNoAvailableKeys = errors.New("all OpenRouter keys are exhausted or rate limited")
+
+type poolKey struct {
+	key    string
+	weight int
+
+	current      int // smooth weighted round-robin state
+	benchedUntil time.Time
+	lastStatus   int
+	lastError    string
+	requests     int64
+	failures     int64
+
+	creditChecked  time.Time
+	usage          float64
+	limit          *float64
+	limitRemaining *float64
+}
+
+// KeyStatus describes a pool key for the admin API. The key itself is masked.
+type KeyStatus struct {
+	Key            string     `json:"key"`
+	Weight         int        `json:"weight"`
+	Available      bool       `json:"available"`
+	BenchedUntil   *time.Time `json:"benched_until,omitempty"`
+	LastStatus     int        `json:"last_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	Requests       int64      `json:"requests"`
+	Failures       int64      `json:"failures"`
+	Usage          float64    `json:"usage"`
+	Limit          *float64   `json:"limit"`
+	LimitRemaining *float64   `json:"limit_remaining"`
+	CreditChecked  *time.Time `json:"credit_checked_at,omitempty"`
+}
+
+// KeyPool rotates requests across several OpenRouter keys using smooth
+// weighted round-robin and benches keys that are rejected upstream.
+type KeyPool struct {
+	mu   sync.Mutex
+	keys []*poolKey
+	now  func() time.Time
+}
+
+// ParseKeyPool parses a comma separated list of keys, each optionally
+// followed by ":weight", e.g. "sk-or-a:3,sk-or-b".
+func ParseKeyPool(spec string) (*KeyPool, error) {
+	pool := &KeyPool{now: time.Now}
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, weight := entry, 1
+		if k, w, found := strings.Cut(entry, ":"); found {
+			n, err := strconv.Atoi(w)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid weight %q for key %s", w, maskKey(k))
+			}
+			key, weight = k, n
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate key %s", maskKey(key))
+		}
+		seen[key] = true
+		pool.keys = append(pool.keys, &poolKey{key: key, weight: weight})
+	}
+
+	if len(pool.keys) == 0 {
+		return nil, errors.New("no API keys configured")
+	}
+	return pool, nil
+}
+
+// Len returns the number of keys in the pool.
+func (p *KeyPool) Len() int {
+	return len(p.keys)
+}
+
+// Keys returns all keys in the pool, including benched ones.
+func (p *KeyPool) Keys() []string {
+	keys := make([]string, len(p.keys))
+	for i, k := range p.keys {
+		keys[i] = k.key
+	}
+	return keys
+}
+
+// Contains reports whether key belongs to the pool.
+func (p *KeyPool) Contains(key string) bool {
+	for _, k := range p.keys {
+		if k.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick returns the next key to use.
+func (p *KeyPool) Pick() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var best *poolKey
+	total := 0
+	for _, k := range p.keys {
+		if k.benchedUntil.After(now) {
+			continue
+		}
+		k.current += k.weight
+		total += k.weight
+		if best == nil || k.current > best.current {
+			best = k
+		}
+	}
+	if best == nil {
+		return "", ErrNoAvailableKeys
+	}
+
+	best.current -= total
+	best.requests++
+	return best.key, nil
+}
+
+// Report records the outcome of a request made with key, benching the key
+// if OpenRouter rejected it. It returns true if the key was benched and the
+// request should be retried with another key.
+func (p *KeyPool) Report(key string, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k := p.find(key)
+	if k == nil || err == nil {
+		return false
+	}
+
+	status := upstreamStatus(err)
+	k.failures++
+	k.lastStatus = status
+	k.lastError = err.Error()
+
+	var bench time.Duration
+	switch status {
+	case http.StatusUnauthorized:
+		bench = benchUnauthorized
+	case http.StatusPaymentRequired:
+		bench = benchNoCredit
+	case http.StatusTooManyRequests:
+		bench = benchRateLimited
+	default:
+		return false
+	}
+
+	k.benchedUntil = p.now().Add(bench)
+	slog.Warn("Benching OpenRouter key", "key", maskKey(key), "status", status, "until", k.benchedUntil)
+	return true
+}
+
+func (p *KeyPool) find(key string) *poolKey {
+	for _, k := range p.keys {
+		if k.key == key {
+			return k
+		}
+	}
+	return nil
+}
+
+// Status returns the state of every key in the pool.
+func (p *KeyPool) Status() []KeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	status := make([]KeyStatus, 0, len(p.keys))
+	for _, k := range p.keys {
+		s := KeyStatus{
+			Key:            maskKey(k.key),
+			Weight:         k.weight,
+			Available:      !k.benchedUntil.After(now),
+			LastStatus:     k.lastStatus,
+			LastError:      k.lastError,
+			Requests:       k.requests,
+			Failures:       k.failures,
+			Usage:          k.usage,
+			Limit:          k.limit,
+			LimitRemaining: k.limitRemaining,
+		}
+		if !s.Available {
+			until := k.benchedUntil
+			s.BenchedUntil = &until
+		}
+		if !k.creditChecked.IsZero() {
+			checked := k.creditChecked
+			s.CreditChecked = &checked
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// keyInfo is the payload of OpenRouter's GET /key endpoint.
+type keyInfo struct {
+	Usage          float64  `json:"usage"`
+	Limit          *float64 `json:"limit"`
+	LimitRemaining *float64 `json:"limit_remaining"`
+}
+
+func (p *KeyPool) updateCredit(key string, info keyInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k := p.find(key)
+	if k == nil {
+		return
+	}
+	k.creditChecked = p.now()
+	k.usage = info.Usage
+	k.limit = info.Limit
+	k.limitRemaining = info.LimitRemaining
+
+	exhausted := info.LimitRemaining != nil && *info.LimitRemaining <= 0
+	switch {
+	case exhausted:
+		k.benchedUntil = p.now().Add(benchNoCredit)
+		k.lastStatus = http.StatusPaymentRequired
+		k.lastError = "credit limit reached"
+	case k.lastStatus == http.StatusPaymentRequired:
+		// Credit was topped up, put the key back into rotation.
+		k.benchedUntil = time.Time{}
+		k.lastStatus = 0
+		k.lastError = ""
+	}
+}
+
+// upstreamStatus extracts the HTTP status code from a go-openai error.
+func upstreamStatus(err error) int {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode
+	}
+	return 0
+}
+
+// upstreamStatusLabel returns the status code for metrics: 200 for success,
+// the upstream status for API errors and 0 for transport errors.
+func upstreamStatusLabel(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	return upstreamStatus(err)
+}
+
+// maskKey shortens a key for logs and status output.
+func maskKey(key string) string {
+	if len(key) <= 12 {
+		return "***"
+	}
+	return key[:8] + "..." + key[len(key)-4:]
+}
+
+// fetchKeyInfo asks OpenRouter for the usage and remaining credit of a key.
+func (o *OpenrouterProvider) fetchKeyInfo(ctx context.Context, key string) (keyInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(o.baseURL, "/")+"/key", nil)
+	if err != nil {
+		return keyInfo{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return keyInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return keyInfo{}, &openai.RequestError{HTTPStatusCode: resp.StatusCode, Err: fmt.Errorf("key info: upstream returned %s", resp.Status)}
+	}
+
+	var body struct {
+		Data keyInfo `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return keyInfo{}, fmt.Errorf("decoding key info: %w", err)
+	}
+	return body.Data, nil
+}
+
+// RefreshKeyCredits checks the remaining credit of every pool key, benching
+// exhausted or invalid keys and restoring topped up ones. It returns the
+// number of keys that are valid and have credit left, and the last error.
+func (o *OpenrouterProvider) RefreshKeyCredits(ctx context.Context) (usable int, err error) {
+	for _, key := range o.keys.Keys() {
+		info, fetchErr := o.fetchKeyInfo(ctx, key)
+		if fetchErr != nil {
+			slog.Warn("Error checking OpenRouter key credit", "key", maskKey(key), "Error", fetchErr)
+			o.keys.Report(key, fetchErr)
+			err = fetchErr
+			continue
+		}
+		o.keys.updateCredit(key, info)
+		if info.LimitRemaining == nil || *info.LimitRemaining > 0 {
+			usable++
+		}
+	}
+	return usable, err
+}
+
+// WatchKeyCredits refreshes key credits now and then every interval.
+func (o *OpenrouterProvider) WatchKeyCredits(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			o.RefreshKeyCredits(context.Background())
+			<-ticker.C
+		}
+	}()
+}
+
+// KeyStatus returns the state of the provider's key pool.
+func (o *OpenrouterProvider) KeyStatus() []KeyStatus {
+	return o.keys.Status()
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	testKeyA = "sk-or-test-key-aaaaaaaaaa"
+	testKeyB = "sk-or-test-key-bbbbbbbbbb"
+	testKeyC = "sk-or-test-key-cccccccccc"
+)
+
+// newTestKeyPool parses spec into a pool whose clock only moves when the
+// returned advance function is called.
+func newTestKeyPool(t *testing.T, spec string) (*KeyPool, func(time.Duration)) {
+	t.Helper()
+	pool, err := ParseKeyPool(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	pool.now = func() time.Time { return now }
+	return pool, func(d time.Duration) { now = now.Add(d) }
+}
+
+// keyStatus returns the pool's status for key.
+func keyStatus(t *testing.T, pool *KeyPool, key string) KeyStatus {
+	t.Helper()
+	for _, s := range pool.Status() {
+		if s.Key == maskKey(key) {
+			return s
+		}
+	}
+	t.Fatalf("key %s not in the pool", maskKey(key))
+	return KeyStatus{}
+}
+
+func TestParseKeyPool(t *testing.T) {
+	pool, err := ParseKeyPool(" " + testKeyA + ":3, " + testKeyB + ",,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Len() != 2 || !pool.Contains(testKeyA) || !pool.Contains(testKeyB) {
+		t.Errorf("keys = %v", pool.Keys())
+	}
+	if w := keyStatus(t, pool, testKeyA).Weight; w != 3 {
+		t.Errorf("weight = %d, want 3", w)
+	}
+
+	for _, spec := range []string{"", " , ", testKeyA + ":0", testKeyA + ":x", testKeyA + "," + testKeyA} {
+		if _, err := ParseKeyPool(spec); err == nil {
+			t.Errorf("ParseKeyPool(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestKeyPoolWeightedRotation(t *testing.T) {
+	pool, _ := newTestKeyPool(t, testKeyA+":3,"+testKeyB+","+testKeyC+":2")
+
+	// Smooth weighted round-robin spreads a heavy key's turns out instead of
+	// picking it several times in a row
+	want := []string{testKeyA, testKeyC, testKeyA, testKeyB, testKeyC, testKeyA}
+	for round := 0; round < 2; round++ {
+		for i, key := range want {
+			got, err := pool.Pick()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != key {
+				t.Errorf("round %d, pick %d = %s, want %s", round, i, maskKey(got), maskKey(key))
+			}
+		}
+	}
+	for key, want := range map[string]int64{testKeyA: 6, testKeyB: 2, testKeyC: 4} {
+		if got := keyStatus(t, pool, key).Requests; got != want {
+			t.Errorf("%s: %d requests, want %d", maskKey(key), got, want)
+		}
+	}
+}
+
+func TestKeyPoolBenching(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		bench  time.Duration
+	}{
+		{http.StatusUnauthorized, benchUnauthorized},
+		{http.StatusPaymentRequired, benchNoCredit},
+		{http.StatusTooManyRequests, benchRateLimited},
+		{http.StatusInternalServerError, 0},
+		{http.StatusBadRequest, 0},
+	} {
+		pool, advance := newTestKeyPool(t, testKeyA+","+testKeyB)
+		err := &openai.APIError{HTTPStatusCode: tc.status, Message: http.StatusText(tc.status)}
+		if benched := pool.Report(testKeyA, err); benched != (tc.bench > 0) {
+			t.Errorf("%d: Report = %v, want %v", tc.status, benched, tc.bench > 0)
+		}
+		status := keyStatus(t, pool, testKeyA)
+		if status.LastStatus != tc.status || status.Failures != 1 || status.Available != (tc.bench == 0) {
+			t.Errorf("%d: status = %+v", tc.status, status)
+		}
+		if tc.bench == 0 {
+			continue
+		}
+
+		// The benched key is skipped until its time is up
+		for i := 0; i < 3; i++ {
+			if key, _ := pool.Pick(); key != testKeyB {
+				t.Errorf("%d: picked the benched key", tc.status)
+			}
+		}
+		advance(tc.bench - time.Second)
+		if keyStatus(t, pool, testKeyA).Available {
+			t.Errorf("%d: key back a second early", tc.status)
+		}
+		advance(time.Second)
+		if !keyStatus(t, pool, testKeyA).Available {
+			t.Errorf("%d: key still benched after %v", tc.status, tc.bench)
+		}
+	}
+
+	pool, _ := newTestKeyPool(t, testKeyA)
+	pool.Report(testKeyA, &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests})
+	if _, err := pool.Pick(); !errors.Is(err, ErrNoAvailableKeys) {
+		t.Errorf("Pick with every key benched: %v", err)
+	}
+	if pool.Report(testKeyA, nil) || pool.Report("sk-or-unknown", errors.New("boom")) {
+		t.Error("Report benched a key for a success or an unknown key")
+	}
+}
+
+func TestProviderRetriesWithNextKey(t *testing.T) {
+	upstream := newFakeOpenRouter(t)
+	keys, _ := newTestKeyPool(t, testKeyA+","+testKeyB)
+	provider := NewOpenrouterProvider(keys, upstream.URL)
+	upstream.Script(fakeResponse{Status: http.StatusTooManyRequests}, fakeResponse{Chunks: []string{"ok"}})
+
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}
+	response, err := provider.Chat(context.Background(), messages, "openai/gpt-4o", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Choices[0].Message.Content != "ok" {
+		t.Errorf("content = %q", response.Choices[0].Message.Content)
+	}
+	if got := upstream.Keys(); len(got) != 2 || got[0] != testKeyA || got[1] != testKeyB {
+		t.Errorf("keys used = %v, want the first then the second", got)
+	}
+	if status := keyStatus(t, keys, testKeyA); status.Available || status.LastStatus != http.StatusTooManyRequests {
+		t.Errorf("rate limited key status = %+v", status)
+	}
+
+	// Errors that are not the key's fault are not retried
+	upstream.Script(fakeResponse{Status: http.StatusBadRequest})
+	if _, err := provider.Chat(context.Background(), messages, "openai/gpt-4o", nil); err == nil {
+		t.Fatal("bad request succeeded")
+	}
+	if got := len(upstream.Keys()); got != 3 {
+		t.Errorf("chat calls = %d, want 3", got)
+	}
+}
+
+func TestRefreshKeyCredits(t *testing.T) {
+	upstream := newFakeOpenRouter(t)
+	keys, _ := newTestKeyPool(t, testKeyA+","+testKeyB)
+	provider := NewOpenrouterProvider(keys, upstream.URL)
+
+	upstream.SetKeyCredit(testKeyA, 2.5)
+	upstream.SetKeyCredit(testKeyB, 0)
+	usable, err := provider.RefreshKeyCredits(context.Background())
+	if usable != 1 || err != nil {
+		t.Fatalf("RefreshKeyCredits = %d, %v; want 1 usable key", usable, err)
+	}
+	a := keyStatus(t, keys, testKeyA)
+	if !a.Available || a.LimitRemaining == nil || *a.LimitRemaining != 2.5 || a.CreditChecked == nil {
+		t.Errorf("key with credit: %+v", a)
+	}
+	if b := keyStatus(t, keys, testKeyB); b.Available || b.LastStatus != http.StatusPaymentRequired {
+		t.Errorf("exhausted key: %+v", b)
+	}
+
+	// A top up puts the key back into rotation
+	upstream.SetKeyCredit(testKeyB, 5)
+	if usable, err := provider.RefreshKeyCredits(context.Background()); usable != 2 || err != nil {
+		t.Errorf("after a top up: RefreshKeyCredits = %d, %v; want 2", usable, err)
+	}
+	if b := keyStatus(t, keys, testKeyB); !b.Available || b.LastStatus != 0 {
+		t.Errorf("topped up key: %+v", b)
+	}
+
+	// Revoked keys are benched
+	upstream.FailKey(http.StatusUnauthorized)
+	if usable, err := provider.RefreshKeyCredits(context.Background()); usable != 0 || err == nil {
+		t.Errorf("with revoked keys: RefreshKeyCredits = %d, %v", usable, err)
+	}
+	if _, err := keys.Pick(); !errors.Is(err, ErrNoAvailableKeys) {
+		t.Errorf("Pick with every key revoked: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// bodyLimitMiddleware rejects request bodies larger than maxBytes with 413.
+// Bodies without a Content-Length are cut off while they are read, which
+// bindJSON reports the same way.
+func bodyLimitMiddleware(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": bodyTooLargeMessage(maxBytes)})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
+
+func bodyTooLargeMessage(maxBytes int64) string {
+	return fmt.Sprintf("request body too large, the limit is %d bytes", maxBytes)
+}
+
+// bindJSON decodes the request body into v. On failure it writes Ollama's
+// error, 413 for bodies over the size limit and 400 otherwise, and returns
+// false.
+func bindJSON(c *gin.Context, v interface{}) bool {
+	err := c.ShouldBindJSON(v)
+	if err == nil {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": bodyTooLargeMessage(tooLarge.Limit)})
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+	return false
+}
+
+// checkPromptLimits enforces the configured maximum number of messages and
+// prompt characters. On failure it writes a 413 and returns false.
+func (s *server) checkPromptLimits(c *gin.Context, messages []openai.ChatCompletionMessage) bool {
+	if s.maxMessages > 0 && len(messages) > s.maxMessages {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("too many messages: %d exceeds the limit of %d", len(messages), s.maxMessages)})
+		return false
+	}
+	if s.maxPromptChars > 0 {
+		if chars := promptChars(messages); chars > s.maxPromptChars {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("prompt too long: %d characters exceeds the limit of %d", chars, s.maxPromptChars)})
+			return false
+		}
+	}
+	return true
+}
+
+// promptChars counts the characters of all text in messages.
+func promptChars(messages []openai.ChatCompletionMessage) int {
+	chars := 0
+	for _, m := range messages {
+		chars += utf8.RuneCountInString(m.Content)
+		for _, part := range m.MultiContent {
+			chars += utf8.RuneCountInString(part.Text)
+		}
+	}
+	return chars
+}
+
+// writeTimeoutMiddleware gives each write of a response timeout to reach the
+// client. Unlike http.Server.WriteTimeout, which bounds the whole response,
+// this lets a stream run as long as it needs while still dropping clients
+// that stop reading.
+func writeTimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w := &deadlineWriter{
+			ResponseWriter: c.Writer,
+			rc:             http.NewResponseController(c.Writer),
+			timeout:        timeout,
+		}
+		// Replace any deadline left over from an earlier request on the
+		// same connection.
+		w.extend()
+		c.Writer = w
+		c.Next()
+	}
+}
+
+// deadlineWriter moves the connection's write deadline forward before every
+// write.
+type deadlineWriter struct {
+	gin.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) extend() {
+	// Writers that do not support deadlines, like test recorders, are
+	// left without one.
+	_ = w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	w.extend()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *deadlineWriter) Flush() {
+	w.extend()
+	w.ResponseWriter.Flush()
+}
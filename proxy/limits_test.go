@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyTooLarge(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) { o.MaxBodyBytes = 64 })
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "` + strings.Repeat("x", 100) + `"}]}`
+
+	// With a Content-Length the request is rejected up front; without one
+	// the body is cut off while it is decoded.
+	for name, reader := range map[string]io.Reader{
+		"content-length": strings.NewReader(body),
+		"chunked":        io.MultiReader(strings.NewReader(body)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/chat", reader)
+			w := httptest.NewRecorder()
+			p.router.ServeHTTP(w, req)
+			expectStatus(t, w, http.StatusRequestEntityTooLarge)
+			if msg, _ := decodeJSON(t, w)["error"].(string); !strings.Contains(msg, "limit is 64 bytes") {
+				t.Errorf("error = %q", msg)
+			}
+		})
+	}
+	if n := len(p.upstream.Requests()); n != 0 {
+		t.Errorf("upstream got %d requests", n)
+	}
+}
+
+func TestTooManyMessages(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) { o.MaxMessages = 2 })
+	messages := []map[string]string{
+		{"role": "user", "content": "one"},
+		{"role": "assistant", "content": "two"},
+		{"role": "user", "content": "three"},
+	}
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{"model": "gpt-4o", "messages": messages})
+	expectStatus(t, w, http.StatusRequestEntityTooLarge)
+	if msg, _ := decodeJSON(t, w)["error"].(string); msg != "too many messages: 3 exceeds the limit of 2" {
+		t.Errorf("error = %q", msg)
+	}
+
+	p.upstream.Script(fakeResponse{Chunks: []string{"ok"}})
+	w = p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{"model": "gpt-4o", "stream": false, "messages": messages[1:]})
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestPromptTooLong(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) { o.MaxPromptChars = 10 })
+	w := p.do(t, http.MethodPost, "/api/generate", map[string]interface{}{
+		"model":  "gpt-4o",
+		"system": "be brief",
+		"prompt": "héllo",
+	})
+	expectStatus(t, w, http.StatusRequestEntityTooLarge)
+	if msg, _ := decodeJSON(t, w)["error"].(string); msg != "prompt too long: 13 characters exceeds the limit of 10" {
+		t.Errorf("error = %q", msg)
+	}
+}
+
+func TestWriteTimeoutAllowsLongStreams(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) { o.WriteTimeout = 50 * time.Millisecond })
+	p.upstream.Script(fakeResponse{Chunks: []string{"a", "b", "c", "d"}, Delay: 30 * time.Millisecond})
+	srv := httptest.NewServer(p.router)
+	defer srv.Close()
+
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`
+	resp, err := http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream cut off after %q: %v", data, err)
+	}
+	if !strings.Contains(string(data), `"done":true`) {
+		t.Errorf("stream did not finish: %s", data)
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "ollama_proxy"
+
+// Buckets for LLM latencies, which range from milliseconds to minutes.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "HTTP requests by route, model and status code.",
+	}, []string{"route", "model", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time to handle an HTTP request, including the whole stream.",
+		Buckets:   latencyBuckets,
+	}, []string{"route", "model"})
+
+	upstreamLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_latency_seconds",
+		Help:      "Time until OpenRouter answers a call, per attempt.",
+		Buckets:   latencyBuckets,
+	}, []string{"operation", "status"})
+
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "time_to_first_token_seconds",
+		Help:      "Time from receiving a streaming request to relaying its first content chunk.",
+		Buckets:   latencyBuckets,
+	}, []string{"model"})
+
+	streamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_duration_seconds",
+		Help:      "Time spent relaying a streaming response.",
+		Buckets:   latencyBuckets,
+	}, []string{"model"})
+
+	tokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tokens_total",
+		Help:      "Tokens sent to (in) and received from (out) OpenRouter.",
+	}, []string{"model", "direction"})
+
+	upstreamRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_retries_total",
+		Help:      "Upstream calls retried with another key after a key was benched.",
+	})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result (hit or miss).",
+	}, []string{"cache", "result"})
+
+	contextShortened = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "context_shortened_total",
+		Help:      "Conversations shortened to fit the model's context window, by strategy.",
+	}, []string{"strategy"})
+
+	inflightStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "inflight_streams",
+		Help:      "Streaming responses currently being relayed.",
+	})
+)
+
+// Gin context keys under which the middleware stores the request start and
+// handlers store the resolved model for request metrics.
+const (
+	requestStartKey = "requestStart"
+	metricsModelKey = "metricsModel"
+)
+
+// otherModelLabel is the model label of requests for models missing from the
+// catalog, so names sent by clients cannot create unbounded series.
+const otherModelLabel = "other"
+
+// modelLabel returns the metrics label for a model: its catalog ID when known
+// is set, otherModelLabel otherwise.
+func modelLabel(id string, known bool) string {
+	if !known {
+		return otherModelLabel
+	}
+	return id
+}
+
+// metricsMiddleware counts requests and measures their duration.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Set(requestStartKey, start)
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		model := c.GetString(metricsModelKey)
+		requestsTotal.WithLabelValues(route, model, strconv.Itoa(c.Writer.Status())).Inc()
+		requestDuration.WithLabelValues(route, model).Observe(time.Since(start).Seconds())
+	}
+}
+
+// cacheResult returns the label for a cache lookup.
+func cacheResult(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+// streamMetrics measures a streaming response for one model.
+type streamMetrics struct {
+	model        string
+	requestStart time.Time
+	streamStart  time.Time
+	firstToken   bool
+}
+
+// startStreamMetrics marks a stream as in flight, labelled with the model the
+// handler resolved. Time to first token is measured from when the request was
+// received, so it includes model resolution and the upstream call.
+func startStreamMetrics(c *gin.Context) *streamMetrics {
+	model := c.GetString(metricsModelKey)
+	inflightStreams.Inc()
+	now := time.Now()
+	requestStart := c.GetTime(requestStartKey)
+	if requestStart.IsZero() {
+		requestStart = now
+	}
+	return &streamMetrics{model: model, requestStart: requestStart, streamStart: now}
+}
+
+// Chunk records a relayed chunk; the first one with content sets the time to
+// first token.
+func (m *streamMetrics) Chunk(content string) {
+	if m.firstToken || content == "" {
+		return
+	}
+	m.firstToken = true
+	timeToFirstToken.WithLabelValues(m.model).Observe(time.Since(m.requestStart).Seconds())
+}
+
+// Done marks the stream as finished.
+func (m *streamMetrics) Done() {
+	inflightStreams.Dec()
+	streamDuration.WithLabelValues(m.model).Observe(time.Since(m.streamStart).Seconds())
+}
@@ -0,0 +1,674 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type OpenrouterProvider struct {
+	keys       *KeyPool
+	clients    map[string]*openai.Client // One client per pool key
+	httpClient *http.Client
+	baseURL    string
+	routing    *ProviderRouting
+
+	mu         sync.RWMutex // Guards modelNames and models
+	modelNames []string     // Shared storage for model names
+	models     []Model      // Catalog entries, index-aligned with modelNames
+}
+
+// defaultBaseURL is OpenRouter's OpenAI compatible API.
+const defaultBaseURL = "https://openrouter.ai/api/v1/"
+
+// NewOpenrouterProvider creates a provider using keys. An empty baseURL
+// selects OpenRouter; tests and self-hosted gateways pass their own.
+func NewOpenrouterProvider(keys *KeyPool, baseURL string) *OpenrouterProvider {
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	baseURL = strings.TrimRight(baseURL, "/") + "/"
+
+	// Create HTTP client with custom headers for OpenRouter
+	httpClient := &http.Client{
+		Transport: &headerTransport{
+			Transport: http.DefaultTransport,
+			Headers: map[string]string{
+				"HTTP-Referer": "http://localhost:11434",
+				"X-Title":      "Ollama Proxy",
+			},
+		},
+	}
+
+	o := &OpenrouterProvider{
+		keys:       keys,
+		clients:    make(map[string]*openai.Client, keys.Len()),
+		httpClient: httpClient,
+		baseURL:    baseURL,
+		modelNames: []string{},
+	}
+	for _, key := range keys.Keys() {
+		o.clients[key] = o.newClient(key)
+	}
+	return o
+}
+
+// newClient creates an OpenAI client for key that shares the provider's
+// transport.
+func (o *OpenrouterProvider) newClient(apiKey string) *openai.Client {
+	config := openai.DefaultConfig(apiKey)
+	config.BaseURL = o.baseURL
+	config.HTTPClient = o.httpClient
+	return openai.NewClientWithConfig(config)
+}
+
+// headerTransport adds custom headers to HTTP requests
+type headerTransport struct {
+	Transport http.RoundTripper
+	Headers   map[string]string
+}
+
+func (h *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for key, value := range h.Headers {
+		req.Header.Set(key, value)
+	}
+	if err := addBodyFields(req); err != nil {
+		return nil, err
+	}
+	return h.Transport.RoundTrip(req)
+}
+
+// SetRouting sets the provider preferences sent with chat requests. It must
+// be called before the provider is used.
+func (o *OpenrouterProvider) SetRouting(routing *ProviderRouting) {
+	o.routing = routing
+}
+
+// withRouting attaches the provider preferences for a chat request to ctx.
+func (o *OpenrouterProvider) withRouting(ctx context.Context, modelName string, options map[string]interface{}) context.Context {
+	prefs := o.routing.preferences(modelName, options)
+	if prefs.IsZero() {
+		return ctx
+	}
+	return withBodyFields(ctx, map[string]interface{}{"provider": prefs})
+}
+
+type upstreamKeyContextKey struct{}
+
+// WithUpstreamKey returns a context that makes the provider call OpenRouter
+// with apiKey instead of the proxy's own key.
+func WithUpstreamKey(ctx context.Context, apiKey string) context.Context {
+	return context.WithValue(ctx, upstreamKeyContextKey{}, apiKey)
+}
+
+// withClient runs call with the client for the request. Requests carrying
+// their own OpenRouter key get a client that shares the proxy's transport.
+// Otherwise keys are taken from the pool, and a key rejected with 401, 402 or
+// 429 is benched and the call retried with the next one.
+func (o *OpenrouterProvider) withClient(ctx context.Context, operation string, call func(*openai.Client) error) error {
+	// Time each attempt for the upstream latency metric
+	timed := func(client *openai.Client) error {
+		start := time.Now()
+		err := call(client)
+		upstreamLatency.WithLabelValues(operation, strconv.Itoa(upstreamStatusLabel(err))).Observe(time.Since(start).Seconds())
+		return err
+	}
+
+	if apiKey, _ := ctx.Value(upstreamKeyContextKey{}).(string); apiKey != "" && !o.keys.Contains(apiKey) {
+		return timed(o.newClient(apiKey))
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < o.keys.Len(); attempt++ {
+		key, err := o.keys.Pick()
+		if err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+
+		if attempt > 0 {
+			upstreamRetries.Inc()
+		}
+		err = timed(o.clients[key])
+		if !o.keys.Report(key, err) {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (o *OpenrouterProvider) Chat(ctx context.Context, messages []openai.ChatCompletionMessage, modelName string, options map[string]interface{}) (_ openai.ChatCompletionResponse, err error) {
+	ctx, span := tracer.Start(ctx, "openrouter.chat", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrModel.String(modelName), attrStream.Bool(false)))
+	defer func() { endSpan(span, err) }()
+
+	// Create a chat completion request
+	req := openai.ChatCompletionRequest{
+		Model:    modelName,
+		Messages: messages,
+		Stream:   false,
+	}
+	applyOptions(&req, options)
+	ctx = o.withRouting(ctx, modelName, options)
+
+	// Call the OpenAI API to get a complete response
+	var resp openai.ChatCompletionResponse
+	err = o.withClient(ctx, "chat", func(client *openai.Client) (err error) {
+		resp, err = client.CreateChatCompletion(ctx, req)
+		return err
+	})
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+
+	span.SetAttributes(
+		attrPromptTokens.Int(resp.Usage.PromptTokens),
+		attrCompletionTokens.Int(resp.Usage.CompletionTokens),
+	)
+	if len(resp.Choices) > 0 {
+		span.SetAttributes(attrFinishReason.String(string(resp.Choices[0].FinishReason)))
+	}
+
+	// Return the complete response
+	return resp, nil
+}
+
+// ChatStream opens a streaming chat completion. Its span covers opening the
+// stream; relaying the chunks is traced by the caller.
+func (o *OpenrouterProvider) ChatStream(ctx context.Context, messages []openai.ChatCompletionMessage, modelName string, options map[string]interface{}) (_ *openai.ChatCompletionStream, err error) {
+	ctx, span := tracer.Start(ctx, "openrouter.chat", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrModel.String(modelName), attrStream.Bool(true)))
+	defer func() { endSpan(span, err) }()
+
+	// Create a chat completion request
+	req := openai.ChatCompletionRequest{
+		Model:    modelName,
+		Messages: messages,
+		Stream:   true,
+		// Ask for token usage in the final chunk for spend tracking
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
+	}
+	applyOptions(&req, options)
+	ctx = o.withRouting(ctx, modelName, options)
+
+	// Call the OpenAI API to get a streaming response
+	var stream *openai.ChatCompletionStream
+	err = o.withClient(ctx, "chat_stream", func(client *openai.Client) (err error) {
+		stream, err = client.CreateChatCompletionStream(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Return the stream for further processing
+	return stream, nil
+}
+
+// applyOptions maps Ollama sampling options onto an OpenAI request. Unknown
+// options are ignored.
+func applyOptions(req *openai.ChatCompletionRequest, options map[string]interface{}) {
+	if t, ok := optionFloat(options, "temperature"); ok {
+		req.Temperature = float32(t)
+		if t == 0 {
+			// go-openai omits a zero temperature, which upstream reads as
+			// the default; send the smallest non-zero value instead.
+			req.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	if v, ok := optionFloat(options, "top_p"); ok {
+		req.TopP = float32(v)
+	}
+	if v, ok := optionFloat(options, "presence_penalty"); ok {
+		req.PresencePenalty = float32(v)
+	}
+	if v, ok := optionFloat(options, "frequency_penalty"); ok {
+		req.FrequencyPenalty = float32(v)
+	}
+	if v, ok := optionFloat(options, "seed"); ok {
+		seed := int(v)
+		req.Seed = &seed
+	}
+	if v, ok := optionFloat(options, "num_predict"); ok && v > 0 {
+		req.MaxTokens = int(v)
+	}
+	if stop, ok := options["stop"].([]interface{}); ok {
+		for _, s := range stop {
+			if str, ok := s.(string); ok {
+				req.Stop = append(req.Stop, str)
+			}
+		}
+	}
+}
+
+// optionFloat returns a numeric option decoded from JSON.
+func optionFloat(options map[string]interface{}, key string) (float64, bool) {
+	switch v := options[key].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+type ModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// ModelPricing holds OpenRouter prices in USD per token.
+type ModelPricing struct {
+	Prompt     float64
+	Completion float64
+	// Known is false for models whose price is not fixed in the catalog:
+	// variable-priced routers such as openrouter/auto, models with missing
+	// or malformed prices, and models missing from the catalog. Their
+	// prices read as zero but must not be taken for free.
+	Known bool
+}
+
+// IsFree reports whether the model is known to cost nothing to use.
+func (p ModelPricing) IsFree() bool {
+	return p.Known && p.Prompt == 0 && p.Completion == 0
+}
+
+type Model struct {
+	Name       string       `json:"name"`
+	Model      string       `json:"model,omitempty"`
+	ModifiedAt string       `json:"modified_at,omitempty"`
+	Size       int64        `json:"size,omitempty"`
+	Digest     string       `json:"digest,omitempty"`
+	Details    ModelDetails `json:"details,omitempty"`
+	ID            string       `json:"-"` // Full OpenRouter ID, e.g. "openai/gpt-4o"
+	ContextLength int64        `json:"-"`
+	Pricing       ModelPricing `json:"-"`
+}
+
+// catalogModel is an entry of OpenRouter's /models response. The go-openai
+// model list drops the OpenRouter specific pricing and context length.
+type catalogModel struct {
+	ID            string `json:"id"`
+	ContextLength int64  `json:"context_length"`
+	Pricing       struct {
+		Prompt     string `json:"prompt"`
+		Completion string `json:"completion"`
+	} `json:"pricing"`
+}
+
+func (o *OpenrouterProvider) fetchCatalog(ctx context.Context) ([]catalogModel, error) {
+	key, err := o.keys.Pick()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(o.baseURL, "/")+"/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := &openai.RequestError{HTTPStatusCode: resp.StatusCode, Err: fmt.Errorf("listing models: upstream returned %s", resp.Status)}
+		o.keys.Report(key, err)
+		return nil, err
+	}
+
+	var catalog struct {
+		Data []catalogModel `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("decoding models: %w", err)
+	}
+	return catalog.Data, nil
+}
+
+// parsePricing parses OpenRouter's price strings. Missing or malformed
+// prices, and the negative prices that mark variable-priced router models,
+// leave the pricing unknown.
+func parsePricing(prompt, completion string) ModelPricing {
+	promptPrice, promptErr := strconv.ParseFloat(prompt, 64)
+	completionPrice, completionErr := strconv.ParseFloat(completion, 64)
+	if promptErr != nil || completionErr != nil || promptPrice < 0 || completionPrice < 0 {
+		return ModelPricing{}
+	}
+	return ModelPricing{Prompt: promptPrice, Completion: completionPrice, Known: true}
+}
+
+// generationCostAttempts and generationCostDelay bound the wait for
+// OpenRouter's generation stats, which appear shortly after a request ends;
+// generationCostTimeout bounds the whole lookup.
+const (
+	generationCostAttempts = 3
+	generationCostDelay    = 500 * time.Millisecond
+	generationCostTimeout  = 10 * time.Second
+)
+
+// GenerationCost returns what OpenRouter billed for a generation, in USD. It
+// is the authoritative cost of requests to models without fixed pricing. The
+// lookup uses the request's own key when it carries one, and a pool key
+// otherwise, as generation stats are shared by the keys of an account.
+func (o *OpenrouterProvider) GenerationCost(ctx context.Context, id string) (float64, error) {
+	key, _ := ctx.Value(upstreamKeyContextKey{}).(string)
+	if key == "" {
+		var err error
+		if key, err = o.keys.Pick(); err != nil {
+			return 0, err
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < generationCostAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(generationCostDelay):
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"generation?id="+url.QueryEscape(id), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := o.httpClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		var generation struct {
+			Data struct {
+				TotalCost *float64 `json:"total_cost"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&generation)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			// Not recorded yet
+			lastErr = fmt.Errorf("generation %s not found", id)
+			continue
+		case resp.StatusCode != http.StatusOK:
+			return 0, fmt.Errorf("looking up generation %s: upstream returned %s", id, resp.Status)
+		case err != nil:
+			return 0, fmt.Errorf("decoding generation %s: %w", id, err)
+		case generation.Data.TotalCost == nil:
+			return 0, fmt.Errorf("generation %s has no cost", id)
+		}
+		return *generation.Data.TotalCost, nil
+	}
+	return 0, lastErr
+}
+
+func (o *OpenrouterProvider) GetModels(ctx context.Context) (_ []Model, err error) {
+	ctx, span := tracer.Start(ctx, "openrouter.catalog", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	currentTime := time.Now().Format(time.RFC3339)
+
+	// Fetch models from the OpenRouter catalog
+	start := time.Now()
+	catalog, err := o.fetchCatalog(ctx)
+	upstreamLatency.WithLabelValues("models", strconv.Itoa(upstreamStatusLabel(err))).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("openrouter.catalog.models", len(catalog)))
+
+	var models []Model
+	modelNames := make([]string, 0, len(catalog))
+	for _, apiModel := range catalog {
+		// Split model name
+		name := shortModelName(apiModel.ID)
+
+		// Store name in shared storage
+		modelNames = append(modelNames, apiModel.ID)
+
+		// Estimate parameter size based on model name patterns
+		parameterSize := "7B"
+		nameToCheck := strings.ToLower(apiModel.ID + " " + name)
+		
+		if strings.Contains(nameToCheck, "70b") {
+			parameterSize = "70B"
+		} else if strings.Contains(nameToCheck, "13b") {
+			parameterSize = "13B"
+		} else if strings.Contains(nameToCheck, "3b") {
+			parameterSize = "3B"
+		} else if strings.Contains(nameToCheck, "1b") {
+			parameterSize = "1B"
+		}
+
+		// Determine architecture based on model name
+		family := "transformer"
+		if strings.Contains(nameToCheck, "llama") {
+			family = "llama"
+		} else if strings.Contains(nameToCheck, "mistral") {
+			family = "mistral"
+		} else if strings.Contains(nameToCheck, "gemma") {
+			family = "gemma"
+		} else if strings.Contains(nameToCheck, "claude") {
+			family = "claude"
+		} else if strings.Contains(nameToCheck, "gpt") {
+			family = "gpt"
+		}
+
+		// Generate a unique digest based on model name
+		digest := fmt.Sprintf("%x", sha256.Sum256([]byte(apiModel.ID)))
+
+		contextLength := apiModel.ContextLength
+		if contextLength == 0 {
+			contextLength = 200000
+		}
+
+		// Create model struct
+		model := Model{
+			Name:       name,
+			Model:      name,
+			ModifiedAt: currentTime,
+			Size:       270898672, // Realistic size for GGUF models
+			Digest:     digest,
+			Details: ModelDetails{
+				ParentModel:       "",
+				Format:            "gguf",
+				Family:            family,
+				Families:          []string{family},
+				ParameterSize:     parameterSize,
+				QuantizationLevel: "Q4_K_M",
+			},
+			ID:            apiModel.ID,
+			ContextLength: contextLength,
+			Pricing:       parsePricing(apiModel.Pricing.Prompt, apiModel.Pricing.Completion),
+		}
+		models = append(models, model)
+	}
+
+	o.mu.Lock()
+	o.modelNames = modelNames
+	o.models = models
+	o.mu.Unlock()
+
+	return models, nil
+}
+
+// catalogIDs returns a snapshot of the full model IDs from the last catalog
+// fetch.
+func (o *OpenrouterProvider) catalogIDs() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.modelNames
+}
+
+// LookupModel returns the catalog entry for a full model ID. If the catalog
+// does not know the model, a minimal entry is synthesized from the ID and the
+// second result is false.
+func (o *OpenrouterProvider) LookupModel(fullName string) (Model, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	for i, id := range o.modelNames {
+		if id == fullName && i < len(o.models) {
+			return o.models[i], true
+		}
+	}
+
+	name := shortModelName(fullName)
+	return Model{
+		ID:     fullName,
+		Name:   name,
+		Model:  name,
+		Digest: fmt.Sprintf("%x", sha256.Sum256([]byte(fullName))),
+		Details: ModelDetails{
+			Format:   "gguf",
+			Family:   "transformer",
+			Families: []string{"transformer"},
+		},
+	}, false
+}
+
+// MaxPricing returns the highest prompt and completion prices among catalog
+// models with fixed pricing, an upper bound for the cost of models without.
+// Known is false when no model in the catalog has a fixed price.
+func (o *OpenrouterProvider) MaxPricing() ModelPricing {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var highest ModelPricing
+	for _, model := range o.models {
+		if !model.Pricing.Known {
+			continue
+		}
+		highest.Known = true
+		highest.Prompt = max(highest.Prompt, model.Pricing.Prompt)
+		highest.Completion = max(highest.Completion, model.Pricing.Completion)
+	}
+	return highest
+}
+
+func (o *OpenrouterProvider) GetModelDetails(ctx context.Context, modelName string) (map[string]interface{}, error) {
+	// Get the full model name first
+	fullModelName, err := o.GetFullModelName(ctx, modelName)
+	if err != nil {
+		return nil, fmt.Errorf("model not found: %s", modelName)
+	}
+
+	// Refresh model info from OpenRouter
+	if _, err := o.GetModels(ctx); err != nil {
+		return nil, fmt.Errorf("failed to fetch model details: %w", err)
+	}
+
+	modelInfo, found := o.LookupModel(fullModelName)
+	if !found {
+		return nil, fmt.Errorf("model not found: %s", modelName)
+	}
+
+	// Create Ollama-compatible response
+	currentTime := time.Now().Format(time.RFC3339)
+	
+	// Estimate parameter size based on model name patterns
+	parameterSize := "7B"
+	parameterCount := int64(7_000_000_000)
+	
+	// Check both the short name and full name for size indicators
+	nameToCheck := strings.ToLower(fullModelName + " " + modelInfo.Name)
+	
+	if strings.Contains(nameToCheck, "70b") {
+		parameterSize = "70B"
+		parameterCount = 70_000_000_000
+	} else if strings.Contains(nameToCheck, "13b") {
+		parameterSize = "13B"
+		parameterCount = 13_000_000_000
+	} else if strings.Contains(nameToCheck, "3b") {
+		parameterSize = "3B"
+		parameterCount = 3_000_000_000
+	} else if strings.Contains(nameToCheck, "1b") {
+		parameterSize = "1B"
+		parameterCount = 1_000_000_000
+	}
+
+	// Determine architecture based on model name
+	architecture := "transformer"
+	if strings.Contains(nameToCheck, "llama") {
+		architecture = "llama"
+	} else if strings.Contains(nameToCheck, "mistral") {
+		architecture = "mistral"
+	} else if strings.Contains(nameToCheck, "gemma") {
+		architecture = "gemma"
+	} else if strings.Contains(nameToCheck, "claude") {
+		architecture = "claude"
+	} else if strings.Contains(nameToCheck, "gpt") {
+		architecture = "gpt"
+	}
+
+	return map[string]interface{}{
+		"modelfile": fmt.Sprintf("# Modelfile generated for %s\nFROM %s", modelName, fullModelName),
+		"parameters": "",
+		"template": "{{ if .System }}{{ .System }}\n{{ end }}{{ if .Prompt }}{{ .Prompt }}{{ end }}",
+		"system": "",
+		"details": map[string]interface{}{
+			"parent_model":       "",
+			"format":             "gguf",
+			"family":             architecture,
+			"families":           []string{architecture},
+			"parameter_size":     parameterSize,
+			"quantization_level": "Q4_K_M",
+		},
+		"model_info": map[string]interface{}{
+			"general.architecture":    architecture,
+			"general.file_type":       1,
+			"general.parameter_count": parameterCount,
+			"general.quantization_version": 2,
+			"llama.context_length":    modelInfo.ContextLength,
+			"llama.embedding_length":  4096,
+			"llama.block_count":       32,
+		},
+		"modified_at": currentTime,
+	}, nil
+}
+
+// GetFullModelName resolves a client supplied model name to a full model ID.
+// It returns ErrModelNotFound for unknown names and an *AmbiguousModelError
+// when several models match equally well.
+func (o *OpenrouterProvider) GetFullModelName(ctx context.Context, alias string) (fullName string, err error) {
+	ctx, span := tracer.Start(ctx, "resolve_model", trace.WithAttributes(attrRequestedModel.String(alias)))
+	defer func() {
+		span.SetAttributes(attrModel.String(fullName))
+		endSpan(span, err)
+	}()
+
+	// If modelNames is empty or not populated yet, try to get models first
+	cached := len(o.catalogIDs()) > 0
+	cacheRequests.WithLabelValues("catalog", cacheResult(cached)).Inc()
+	span.SetAttributes(attribute.Bool("catalog.cached", cached))
+	if !cached {
+		_, err := o.GetModels(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get models: %w", err)
+		}
+	}
+
+	return resolveModelName(o.catalogIDs(), alias)
+}
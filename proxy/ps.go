@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultKeepAlive mirrors Ollama's default of keeping a model loaded for
+// five minutes after its last request.
+const defaultKeepAlive = 5 * time.Minute
+
+// runningModel is a model that is either serving requests right now or was
+// used recently enough that it is still considered "loaded".
+type runningModel struct {
+	model     Model
+	fullName  string
+	keepAlive time.Duration
+	expiresAt time.Time
+	active    int
+}
+
+// modelTracker keeps track of in-flight and recently used models so that
+// /api/ps can report them the way Ollama does.
+type modelTracker struct {
+	mu     sync.Mutex
+	models map[string]*runningModel
+	now    func() time.Time
+}
+
+func newModelTracker() *modelTracker {
+	return &modelTracker{
+		models: make(map[string]*runningModel),
+		now:    time.Now,
+	}
+}
+
+// parseKeepAlive converts Ollama's keep_alive value into a duration. Numbers
+// are seconds, strings are Go durations (or bare numbers of seconds), and any
+// negative value keeps the model loaded indefinitely.
+func parseKeepAlive(value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case nil:
+		return defaultKeepAlive, nil
+	case float64:
+		return time.Duration(v * float64(time.Second)), nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case string:
+		if v == "" {
+			return defaultKeepAlive, nil
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			return d, nil
+		}
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+			return time.Duration(seconds * float64(time.Second)), nil
+		}
+		return 0, fmt.Errorf("invalid keep_alive duration: %q", v)
+	default:
+		return 0, fmt.Errorf("invalid keep_alive type: %T", value)
+	}
+}
+
+func (t *modelTracker) expiry(keepAlive time.Duration) time.Time {
+	if keepAlive < 0 {
+		// Ollama reports "forever" as a date far in the future.
+		return t.now().AddDate(100, 0, 0)
+	}
+	return t.now().Add(keepAlive)
+}
+
+// Acquire marks a model as in use and returns a function that must be called
+// once the request has finished. The keep_alive countdown starts on release.
+func (t *modelTracker) Acquire(model Model, fullName string, keepAlive time.Duration) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(t.now())
+	rm, ok := t.models[fullName]
+	if !ok {
+		rm = &runningModel{model: model, fullName: fullName}
+		t.models[fullName] = rm
+	}
+	rm.active++
+	rm.keepAlive = keepAlive
+	rm.expiresAt = t.expiry(keepAlive)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.release(fullName) })
+	}
+}
+
+func (t *modelTracker) release(fullName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rm, ok := t.models[fullName]
+	if !ok {
+		return
+	}
+	rm.active--
+	if rm.active > 0 {
+		return
+	}
+	rm.active = 0
+	if rm.keepAlive == 0 {
+		delete(t.models, fullName)
+		return
+	}
+	rm.expiresAt = t.expiry(rm.keepAlive)
+}
+
+// Unload drops a model once no request is using it (keep_alive: 0).
+func (t *modelTracker) Unload(fullName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rm, ok := t.models[fullName]
+	if !ok {
+		return
+	}
+	if rm.active > 0 {
+		rm.keepAlive = 0
+		return
+	}
+	delete(t.models, fullName)
+}
+
+// prune drops the idle models whose keep_alive has expired. t.mu must be
+// held.
+func (t *modelTracker) prune(now time.Time) {
+	for name, rm := range t.models {
+		if rm.active == 0 && !rm.expiresAt.After(now) {
+			delete(t.models, name)
+		}
+	}
+}
+
+// List returns the running models in Ollama's /api/ps format, pruning any
+// whose keep_alive has expired.
+func (t *modelTracker) List() []map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(t.now())
+	running := make([]*runningModel, 0, len(t.models))
+	for _, rm := range t.models {
+		running = append(running, rm)
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].fullName < running[j].fullName
+	})
+
+	result := make([]map[string]interface{}, 0, len(running))
+	for _, rm := range running {
+		result = append(result, map[string]interface{}{
+			"name":            rm.model.Name,
+			"model":           rm.model.Model,
+			"size":            rm.model.Size,
+			"digest":          rm.model.Digest,
+			"details":         rm.model.Details,
+			"expires_at":      rm.expiresAt.Format(time.RFC3339Nano),
+			"size_vram":       rm.model.Size,
+			"active_requests": rm.active,
+		})
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// newTestTracker returns a tracker whose clock only moves when the returned
+// advance function is called.
+func newTestTracker() (*modelTracker, func(time.Duration)) {
+	t := newModelTracker()
+	now := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	t.now = func() time.Time { return now }
+	return t, func(d time.Duration) { now = now.Add(d) }
+}
+
+// running returns the active requests of each listed model by name.
+func running(tracker *modelTracker) map[string]int {
+	models := make(map[string]int)
+	for _, m := range tracker.List() {
+		models[m["name"].(string)] = m["active_requests"].(int)
+	}
+	return models
+}
+
+func TestModelTrackerExpiry(t *testing.T) {
+	tracker, advance := newTestTracker()
+	gpt := Model{Name: "gpt-4o"}
+
+	first := tracker.Acquire(gpt, "openai/gpt-4o", time.Minute)
+	second := tracker.Acquire(gpt, "openai/gpt-4o", time.Minute)
+	if got := running(tracker)["gpt-4o"]; got != 2 {
+		t.Errorf("active requests = %d, want 2", got)
+	}
+
+	// Active models never expire, and a release counts only once
+	advance(time.Hour)
+	first()
+	first()
+	if got, ok := running(tracker)["gpt-4o"]; !ok || got != 1 {
+		t.Errorf("active requests = %d (listed %v), want 1", got, ok)
+	}
+
+	// The keep_alive countdown starts when the last request ends
+	second()
+	advance(59 * time.Second)
+	if _, ok := running(tracker)["gpt-4o"]; !ok {
+		t.Error("model expired before its keep_alive")
+	}
+	advance(time.Second)
+	if _, ok := running(tracker)["gpt-4o"]; ok {
+		t.Error("model still listed after its keep_alive")
+	}
+}
+
+func TestModelTrackerKeepAlive(t *testing.T) {
+	tracker, advance := newTestTracker()
+
+	// A negative keep_alive keeps the model loaded indefinitely
+	tracker.Acquire(Model{Name: "forever"}, "vendor/forever", -1)()
+	// Zero unloads it as soon as the request ends
+	release := tracker.Acquire(Model{Name: "once"}, "vendor/once", 0)
+	if _, ok := running(tracker)["once"]; !ok {
+		t.Error("model with an active request not listed")
+	}
+	release()
+
+	advance(50 * 365 * 24 * time.Hour)
+	if models := running(tracker); len(models) != 1 || models["forever"] != 0 {
+		t.Errorf("running models = %v, want only forever", models)
+	}
+
+	// Unload waits for active requests
+	release = tracker.Acquire(Model{Name: "busy"}, "vendor/busy", time.Hour)
+	tracker.Unload("vendor/busy")
+	if _, ok := running(tracker)["busy"]; !ok {
+		t.Error("model unloaded during a request")
+	}
+	release()
+	if _, ok := running(tracker)["busy"]; ok {
+		t.Error("model still listed after unload and release")
+	}
+}
+
+func TestModelTrackerPrunesOnAcquire(t *testing.T) {
+	tracker, advance := newTestTracker()
+	tracker.Acquire(Model{Name: "old"}, "vendor/old", time.Minute)()
+	advance(time.Hour)
+	tracker.Acquire(Model{Name: "new"}, "vendor/new", time.Minute)()
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if _, ok := tracker.models["vendor/old"]; ok || len(tracker.models) != 1 {
+		t.Errorf("tracked models = %d, want the expired one pruned", len(tracker.models))
+	}
+}
+
+func TestParseKeepAlive(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  time.Duration
+	}{
+		{nil, defaultKeepAlive},
+		{"", defaultKeepAlive},
+		{float64(30), 30 * time.Second},
+		{"10m", 10 * time.Minute},
+		{"90", 90 * time.Second},
+		{float64(-1), -time.Second},
+		{"-1m", -time.Minute},
+	} {
+		if got, err := parseKeepAlive(tc.value); err != nil || got != tc.want {
+			t.Errorf("parseKeepAlive(%v) = %v, %v; want %v", tc.value, got, err, tc.want)
+		}
+	}
+	for _, value := range []interface{}{"soon", true} {
+		if _, err := parseKeepAlive(value); err == nil {
+			t.Errorf("parseKeepAlive(%v) succeeded", value)
+		}
+	}
+}
+
+func TestPSTracksCatalogModelsOnly(t *testing.T) {
+	p := newTestProxy(t)
+	for _, model := range []string{"gpt-4o", "vendor/made-up"} {
+		expectStatus(t, p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+			"model":      model,
+			"stream":     false,
+			"keep_alive": -1,
+			"messages":   []map[string]string{{"role": "user", "content": "hi"}},
+		}), http.StatusOK)
+	}
+
+	models := decodeJSON(t, p.do(t, http.MethodGet, "/api/ps", nil))["models"].([]interface{})
+	if len(models) != 1 || models[0].(map[string]interface{})["name"] != "gpt-4o" {
+		t.Errorf("running models = %v, want only gpt-4o", models)
+	}
+}
+
+func TestPSShowsBudgetFallback(t *testing.T) {
+	spend := openTestSpendStore(t)
+	spend.Record("127.0.0.1", "openai/gpt-4o", openai.Usage{PromptTokens: 10, TotalTokens: 10}, 5, false)
+	p := newTestProxy(t, func(o *Options) {
+		o.Spend = spend
+		o.Budgets = &Budgets{DefaultUser: Budget{DailyUSD: 1}, FallbackModel: "mistralai/mistral-7b-instruct:free"}
+	})
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+	}), http.StatusOK)
+
+	models := decodeJSON(t, p.do(t, http.MethodGet, "/api/ps", nil))["models"].([]interface{})
+	if len(models) != 1 || models[0].(map[string]interface{})["name"] != "mistral-7b-instruct:free" {
+		t.Errorf("running models = %v, want the fallback model", models)
+	}
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// RateLimit configures the limits for one user or model. Zero disables a
+// limit.
+type RateLimit struct {
+	RequestsPerMinute    float64 `json:"requests_per_minute"`
+	TokensPerMinute      float64 `json:"tokens_per_minute"`
+	MaxConcurrentStreams int     `json:"max_concurrent_streams"`
+}
+
+// rateLimitConfig is the format of the rate limits file:
+//
+//	{
+//	  "default_user": {"requests_per_minute": 60, "tokens_per_minute": 200000, "max_concurrent_streams": 4},
+//	  "users": {"ci": {"requests_per_minute": 10}},
+//	  "models": {"anthropic/claude-3-opus*": {"tokens_per_minute": 50000}}
+//	}
+//
+// Users without an entry get default_user. Model keys are globs matched
+// against the full model ID; the limit applies to all users combined.
+type rateLimitConfig struct {
+	DefaultUser *RateLimit           `json:"default_user"`
+	Users       map[string]RateLimit `json:"users"`
+	Models      map[string]RateLimit `json:"models"`
+}
+
+// RateLimitError is returned when a request exceeds a limit.
+type RateLimitError struct {
+	Scope      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry in %s", e.Scope, e.RetryAfter.Round(time.Second))
+}
+
+// tokenBucket refills continuously at rate per second up to capacity. It may
+// go into debt when actual usage exceeds what was reserved up front.
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(perMinute float64, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBucket{capacity: perMinute, rate: perMinute / 60, tokens: perMinute, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until n tokens are available, or zero if they are
+// available now. Requests larger than the bucket only need a full bucket.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	n = math.Min(n, b.capacity)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely. A nil bucket,
+// for a disabled limit, is always full.
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+type limitState struct {
+	scope    string
+	limit    RateLimit
+	requests *tokenBucket
+	tokens   *tokenBucket
+	streams  int
+	active   int // Requests not yet released, streaming or not
+}
+
+func (s *limitState) check(tokens float64, stream bool, now time.Time) time.Duration {
+	if stream && s.limit.MaxConcurrentStreams > 0 && s.streams >= s.limit.MaxConcurrentStreams {
+		// There is no way to know when a stream ends; suggest a short wait.
+		return time.Second
+	}
+	return max(s.requests.wait(1, now), s.tokens.wait(tokens, now))
+}
+
+// idle reports whether the state holds nothing a new one would not: no
+// requests awaiting release and full buckets.
+func (s *limitState) idle(now time.Time) bool {
+	return s.active == 0 && s.requests.full(now) && s.tokens.full(now)
+}
+
+// limitSweepInterval is how often idle limit states are dropped, so clients
+// that come and go do not accumulate.
+const limitSweepInterval = time.Minute
+
+// RateLimiter enforces per-user and per-model request, token and stream
+// limits.
+type RateLimiter struct {
+	mu        sync.Mutex
+	config    rateLimitConfig
+	models    []string // Model patterns, sorted for deterministic matching
+	states    map[string]*limitState
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// LoadRateLimiter reads a JSON rate limits file.
+func LoadRateLimiter(filePath string) (*RateLimiter, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var config rateLimitConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing rate limits file: %w", err)
+	}
+
+	limiter := &RateLimiter{
+		config:    config,
+		states:    make(map[string]*limitState),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+	for pattern := range config.Models {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid model pattern %q: %w", pattern, err)
+		}
+		limiter.models = append(limiter.models, pattern)
+	}
+	sort.Strings(limiter.models)
+	return limiter, nil
+}
+
+func (l *RateLimiter) state(scope string, limit RateLimit) *limitState {
+	s, ok := l.states[scope]
+	if !ok {
+		now := l.now()
+		s = &limitState{
+			scope:    scope,
+			limit:    limit,
+			requests: newTokenBucket(limit.RequestsPerMinute, now),
+			tokens:   newTokenBucket(limit.TokensPerMinute, now),
+		}
+		l.states[scope] = s
+	}
+	return s
+}
+
+// sweep drops idle states. Dropping them loses nothing, as a state created
+// again starts with full buckets. The caller must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for scope, s := range l.states {
+		if s.idle(now) {
+			delete(l.states, scope)
+		}
+	}
+}
+
+// scopes returns the limit states that apply to a request.
+func (l *RateLimiter) scopes(user, model string) []*limitState {
+	var states []*limitState
+	if limit, ok := l.config.Users[user]; ok {
+		states = append(states, l.state("user "+user, limit))
+	} else if l.config.DefaultUser != nil {
+		states = append(states, l.state("user "+user, *l.config.DefaultUser))
+	}
+	for _, pattern := range l.models {
+		if ok, _ := path.Match(pattern, model); ok {
+			states = append(states, l.state("model "+pattern, l.config.Models[pattern]))
+			break
+		}
+	}
+	return states
+}
+
+// Acquire reserves one request and an estimated number of tokens for user on
+// model. The returned release function must be called when the request is
+// done with the number of tokens actually used, so the token buckets can be
+// corrected and stream slots freed.
+func (l *RateLimiter) Acquire(user, model string, tokens int, stream bool) (func(used int), error) {
+	if l == nil {
+		return func(int) {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	states := l.scopes(user, model)
+	for _, s := range states {
+		if wait := s.check(float64(tokens), stream, now); wait > 0 {
+			return nil, &RateLimitError{Scope: s.scope, RetryAfter: wait}
+		}
+	}
+
+	for _, s := range states {
+		s.requests.take(1)
+		s.tokens.take(float64(tokens))
+		s.active++
+		if stream {
+			s.streams++
+		}
+	}
+
+	var once sync.Once
+	return func(used int) {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, s := range states {
+				s.tokens.take(float64(used - tokens))
+				s.active--
+				if stream {
+					s.streams--
+				}
+			}
+		})
+	}, nil
+}
+
+// estimateTokens roughly estimates the prompt size of messages at four
+// characters per token plus a small per-message overhead.
+func estimateTokens(messages []openai.ChatCompletionMessage) int {
+	tokens := 0
+	for _, m := range messages {
+		tokens += 4 + estimateTextTokens(m.Content)
+	}
+	return tokens
+}
+
+// estimateTextTokens estimates the number of tokens in text.
+func estimateTextTokens(text string) int {
+	return (len(text) + 3) / 4
+}
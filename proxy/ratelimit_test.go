@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestLimiter loads a limiter from config whose clock only moves when the
+// returned advance function is called.
+func newTestLimiter(t *testing.T, config string) (*RateLimiter, func(time.Duration)) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "limits.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := LoadRateLimiter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	limiter.lastSweep = now
+	return limiter, func(d time.Duration) { now = now.Add(d) }
+}
+
+// retryAfter returns the wait suggested by a rate limit error.
+func retryAfter(t *testing.T, err error) time.Duration {
+	t.Helper()
+	var limitErr *RateLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("err = %v, want a RateLimitError", err)
+	}
+	return limitErr.RetryAfter
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(60, start) // One per second
+	if wait := b.wait(60, start); wait != 0 {
+		t.Errorf("full bucket: wait = %v", wait)
+	}
+	b.take(60)
+	if wait := b.wait(1, start); wait != time.Second {
+		t.Errorf("empty bucket: wait = %v, want 1s", wait)
+	}
+	if wait := b.wait(1, start.Add(time.Second)); wait != 0 {
+		t.Errorf("after refilling one token: wait = %v", wait)
+	}
+	// Requests larger than the bucket wait for a full one
+	if wait := b.wait(1000, start.Add(time.Second)); wait != 59*time.Second {
+		t.Errorf("oversized request: wait = %v, want 59s", wait)
+	}
+	// Refills stop at capacity
+	if b.wait(0, start.Add(time.Hour)); b.tokens != 60 {
+		t.Errorf("tokens after an hour = %v, want 60", b.tokens)
+	}
+	// Usage beyond the reservation puts the bucket in debt
+	b.take(90)
+	if wait := b.wait(1, start.Add(time.Hour)); wait != 31*time.Second {
+		t.Errorf("bucket in debt: wait = %v, want 31s", wait)
+	}
+
+	if newTokenBucket(0, start) != nil {
+		t.Error("a zero limit creates a bucket")
+	}
+	var disabled *tokenBucket
+	if wait := disabled.wait(1e9, start); wait != 0 || !disabled.full(start) {
+		t.Error("a disabled bucket limits")
+	}
+}
+
+func TestRateLimiterRequestsAndTokens(t *testing.T) {
+	limiter, advance := newTestLimiter(t, `{
+		"default_user": {"requests_per_minute": 2},
+		"users": {"ci": {"tokens_per_minute": 1000}},
+		"models": {"anthropic/*": {"requests_per_minute": 1}}
+	}`)
+
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.Acquire("alice", "openai/gpt-4o", 10, false); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	_, err := limiter.Acquire("alice", "openai/gpt-4o", 10, false)
+	if wait := retryAfter(t, err); wait != 30*time.Second {
+		t.Errorf("third request: retry after %v, want 30s", wait)
+	}
+	// Users are limited separately
+	if _, err := limiter.Acquire("bob", "openai/gpt-4o", 10, false); err != nil {
+		t.Errorf("bob limited by alice's requests: %v", err)
+	}
+	advance(30 * time.Second)
+	if _, err := limiter.Acquire("alice", "openai/gpt-4o", 10, false); err != nil {
+		t.Errorf("after refilling: %v", err)
+	}
+
+	// A model limit applies to all users combined
+	if _, err := limiter.Acquire("bob", "anthropic/claude-3-opus", 10, false); err != nil {
+		t.Fatal(err)
+	}
+	_, err = limiter.Acquire("ci", "anthropic/claude-3-opus", 10, false)
+	var limitErr *RateLimitError
+	if !errors.As(err, &limitErr) || limitErr.Scope != "model anthropic/*" {
+		t.Errorf("err = %v, want the model limit", err)
+	}
+
+	// Tokens used beyond the estimate are charged on release
+	release, err := limiter.Acquire("ci", "openai/gpt-4o", 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(1000)
+	_, err = limiter.Acquire("ci", "openai/gpt-4o", 100, false)
+	if wait := retryAfter(t, err); wait != 6*time.Second {
+		t.Errorf("after overspending: retry after %v, want 6s", wait)
+	}
+}
+
+func TestRateLimiterStreams(t *testing.T) {
+	limiter, _ := newTestLimiter(t, `{"default_user": {"max_concurrent_streams": 2}}`)
+
+	first, err := limiter.Acquire("alice", "openai/gpt-4o", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire("alice", "openai/gpt-4o", 10, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire("alice", "openai/gpt-4o", 10, true); err == nil {
+		t.Fatal("third concurrent stream allowed")
+	}
+	// The cap only counts streams
+	if _, err := limiter.Acquire("alice", "openai/gpt-4o", 10, false); err != nil {
+		t.Errorf("non-streaming request limited: %v", err)
+	}
+
+	// Releasing twice frees one slot only
+	first(10)
+	first(10)
+	if _, err := limiter.Acquire("alice", "openai/gpt-4o", 10, true); err != nil {
+		t.Errorf("after a stream ended: %v", err)
+	}
+	if _, err := limiter.Acquire("alice", "openai/gpt-4o", 10, true); err == nil {
+		t.Error("double release freed two slots")
+	}
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	limiter, advance := newTestLimiter(t, `{"default_user": {"requests_per_minute": 60}}`)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		release, err := limiter.Acquire(ip, "openai/gpt-4o", 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip != "10.0.0.3" {
+			release(10)
+		}
+	}
+	if len(limiter.states) != 3 {
+		t.Fatalf("states = %d, want 3", len(limiter.states))
+	}
+
+	// A client whose bucket is not yet full is kept
+	advance(30 * time.Second)
+	limiter.Acquire("10.0.0.4", "openai/gpt-4o", 10, false)
+	advance(limitSweepInterval)
+	limiter.Acquire("10.0.0.5", "openai/gpt-4o", 10, false)
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	for _, scope := range []string{"user 10.0.0.1", "user 10.0.0.2"} {
+		if _, ok := limiter.states[scope]; ok {
+			t.Errorf("idle %s kept", scope)
+		}
+	}
+	// 10.0.0.3 still has a request in flight, 10.0.0.4 a bucket refilling
+	for _, scope := range []string{"user 10.0.0.3", "user 10.0.0.4", "user 10.0.0.5"} {
+		if _, ok := limiter.states[scope]; !ok {
+			t.Errorf("%s evicted", scope)
+		}
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	limiter, _ := newTestLimiter(t, `{"default_user": {"requests_per_minute": 1}}`)
+	p := newTestProxy(t, func(o *Options) { o.Limiter = limiter })
+	chat := map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+	}
+
+	expectStatus(t, p.do(t, http.MethodPost, "/api/chat", chat), http.StatusOK)
+	w := p.do(t, http.MethodPost, "/api/chat", chat)
+	expectStatus(t, w, http.StatusTooManyRequests)
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	if body := decodeJSON(t, w); body["error"] == nil {
+		t.Error("429 without an error message")
+	}
+	if len(p.upstream.Requests()) != 1 {
+		t.Error("limited request reached upstream")
+	}
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Built-in redaction rules, applied in this order. When a pattern has a
+// capture group only the first group is replaced, so "API_KEY=abc" keeps its
+// variable name.
+var builtinRedactionRules = []struct {
+	name    string
+	pattern string
+}{
+	{"private_key", `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+	{"env_secret", `(?i)\b[A-Z0-9_]*(?:SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|ACCESS_?KEY|PRIVATE_?KEY)[A-Z0-9_]*\s*[=:]\s*["']?([^\s"']{8,})`},
+	{"api_key", `\b(?:sk-(?:or-v1-|ant-|proj-)?[A-Za-z0-9_-]{20,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}|xox[abprs]-[A-Za-z0-9-]{10,}|AIza[0-9A-Za-z_-]{35}|glpat-[A-Za-z0-9_-]{20,})\b`},
+	{"email", `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`},
+	{"phone", `(?:\+\d{1,3}[ .-]?)?\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b|\+\d{1,3}(?:[ .-]?\d{2,4}){3,4}\b`},
+}
+
+// redactionConfig is the format of the redaction file:
+//
+//	{
+//	  "rules": ["private_key", "env_secret", "api_key", "email", "phone"],
+//	  "patterns": {"employee_id": "EMP-[0-9]{6}"},
+//	  "restore": true
+//	}
+//
+// An empty or missing rules list enables every built-in rule. Patterns are
+// custom regular expressions applied after the built-in rules.
+type redactionConfig struct {
+	Rules    []string          `json:"rules"`
+	Patterns map[string]string `json:"patterns"`
+	Restore  bool              `json:"restore"`
+}
+
+type redactionRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// Redactor replaces secrets and personal data in outgoing messages with
+// placeholders such as [REDACTED_EMAIL_1]. If Restore is set, placeholders
+// the model echoes back are replaced with the original values in responses
+// to the client.
+type Redactor struct {
+	rules   []redactionRule
+	Restore bool
+}
+
+// NewRedactor builds a redactor from built-in rule names (all of them when
+// empty) and custom patterns keyed by name.
+func NewRedactor(builtins []string, patterns map[string]string) (*Redactor, error) {
+	r := &Redactor{}
+
+	enabled := make(map[string]bool, len(builtins))
+	for _, name := range builtins {
+		enabled[name] = true
+	}
+	for _, rule := range builtinRedactionRules {
+		if len(builtins) == 0 || enabled[rule.name] {
+			r.rules = append(r.rules, redactionRule{name: rule.name, re: regexp.MustCompile(rule.pattern)})
+			delete(enabled, rule.name)
+		}
+	}
+	for name := range enabled {
+		return nil, fmt.Errorf("unknown redaction rule %q", name)
+	}
+
+	names := make([]string, 0, len(patterns))
+	for name := range patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(patterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %w", name, err)
+		}
+		r.rules = append(r.rules, redactionRule{name: name, re: re})
+	}
+	return r, nil
+}
+
+// LoadRedactor reads a redaction file.
+func LoadRedactor(path string) (*Redactor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg redactionConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	r, err := NewRedactor(cfg.Rules, cfg.Patterns)
+	if err != nil {
+		return nil, err
+	}
+	r.Restore = cfg.Restore
+	return r, nil
+}
+
+// Redact returns a copy of messages with every match replaced by a
+// placeholder, along with the redactions made. A nil Redactor returns the
+// messages unchanged.
+func (r *Redactor) Redact(messages []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, *Redactions) {
+	if r == nil {
+		return messages, nil
+	}
+
+	red := newRedactions(r.Restore)
+	out := r.redactMessages(red, messages)
+	if len(red.placeholders) == 0 {
+		return out, nil
+	}
+	return out, red
+}
+
+// Audit returns a hook for AuditLogger.Redact that masks the bodies of audit
+// records with the same rules. Messages are already redacted before they are
+// forwarded, but responses may hold restored values and errors may echo the
+// request. A nil Redactor returns nil.
+func (r *Redactor) Audit() AuditRedactor {
+	if r == nil {
+		return nil
+	}
+	return func(rec *AuditRecord) {
+		red := newRedactions(false)
+		rec.Messages = r.redactMessages(red, rec.Messages)
+		rec.Response = r.redactText(red, rec.Response)
+		rec.Error = r.redactText(red, rec.Error)
+	}
+}
+
+func newRedactions(restore bool) *Redactions {
+	return &Redactions{
+		restore:      restore,
+		placeholders: make(map[string]string),
+		counts:       make(map[string]int),
+	}
+}
+
+// redactMessages returns a copy of messages with the text of every message
+// redacted into red.
+func (r *Redactor) redactMessages(red *Redactions, messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	out := make([]openai.ChatCompletionMessage, len(messages))
+	for i, m := range messages {
+		m.Content = r.redactText(red, m.Content)
+		if len(m.MultiContent) > 0 {
+			parts := make([]openai.ChatMessagePart, len(m.MultiContent))
+			for j, part := range m.MultiContent {
+				if part.Type == openai.ChatMessagePartTypeText {
+					part.Text = r.redactText(red, part.Text)
+				}
+				parts[j] = part
+			}
+			m.MultiContent = parts
+		}
+		if len(m.ToolCalls) > 0 {
+			calls := make([]openai.ToolCall, len(m.ToolCalls))
+			for j, call := range m.ToolCalls {
+				call.Function.Arguments = r.redactText(red, call.Function.Arguments)
+				calls[j] = call
+			}
+			m.ToolCalls = calls
+		}
+		out[i] = m
+	}
+	return out
+}
+
+func (r *Redactor) redactText(red *Redactions, text string) string {
+	if text == "" {
+		return text
+	}
+	for _, rule := range r.rules {
+		text = replaceMatches(rule.re, text, func(value string) string {
+			return red.placeholder(rule.name, value)
+		})
+	}
+	return text
+}
+
+// replaceMatches replaces each match of re, or its first capture group if
+// the pattern has one, with the result of repl.
+func replaceMatches(re *regexp.Regexp, text string, repl func(string) string) string {
+	group := 0
+	if re.NumSubexp() > 0 {
+		group = 1
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[2*group], loc[2*group+1]
+		if start < 0 {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(repl(text[start:end]))
+		last = end
+	}
+	if last == 0 {
+		return text
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// Redactions records the placeholders substituted into one request.
+type Redactions struct {
+	restore      bool
+	placeholders map[string]string // original value -> placeholder
+	counts       map[string]int    // rule name -> distinct values
+	replacer     *strings.Replacer
+}
+
+// placeholder returns the placeholder for value, reusing it when the same
+// value appears more than once so the model sees a consistent token.
+func (r *Redactions) placeholder(rule, value string) string {
+	if p, ok := r.placeholders[value]; ok {
+		return p
+	}
+	r.counts[rule]++
+	p := fmt.Sprintf("[REDACTED_%s_%d]", strings.ToUpper(rule), r.counts[rule])
+	r.placeholders[value] = p
+	return p
+}
+
+// Counts returns the number of distinct values redacted per rule.
+func (r *Redactions) Counts() map[string]int {
+	if r == nil {
+		return nil
+	}
+	return r.counts
+}
+
+// Restore replaces placeholders in text with the original values when
+// restoring is enabled.
+func (r *Redactions) Restore(text string) string {
+	if r == nil || !r.restore {
+		return text
+	}
+	if r.replacer == nil {
+		pairs := make([]string, 0, 2*len(r.placeholders))
+		for value, p := range r.placeholders {
+			pairs = append(pairs, p, value)
+		}
+		r.replacer = strings.NewReplacer(pairs...)
+	}
+	return r.replacer.Replace(text)
+}
+
+// Stream returns a restorer for a streamed response, in which placeholders
+// may be split across chunks.
+func (r *Redactions) Stream() *RestoreStream {
+	if r == nil || !r.restore {
+		return nil
+	}
+	return &RestoreStream{redactions: r}
+}
+
+// RestoreStream restores placeholders in a stream of chunks. It holds back a
+// trailing partial placeholder until the next chunk completes or rules it
+// out. A nil RestoreStream passes chunks through unchanged.
+type RestoreStream struct {
+	redactions *Redactions
+	pending    string
+}
+
+// Next returns the restored text that can be sent for chunk.
+func (s *RestoreStream) Next(chunk string) string {
+	if s == nil {
+		return chunk
+	}
+	text := s.pending + chunk
+	s.pending = ""
+	if i := strings.LastIndexByte(text, '['); i >= 0 && s.partialPlaceholder(text[i:]) {
+		text, s.pending = text[:i], text[i:]
+	}
+	return s.redactions.Restore(text)
+}
+
+// Flush returns any text still held back at the end of the stream.
+func (s *RestoreStream) Flush() string {
+	if s == nil {
+		return ""
+	}
+	text := s.pending
+	s.pending = ""
+	return s.redactions.Restore(text)
+}
+
+func (s *RestoreStream) partialPlaceholder(tail string) bool {
+	for _, p := range s.redactions.placeholders {
+		if len(tail) < len(p) && strings.HasPrefix(p, tail) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrModelNotFound is returned when a name matches no model in the catalog.
+var ErrModelNotFound = errors.New("model not found")
+
+// AmbiguousModelError is returned when a name matches several models and
+// none of them is a better match than the others.
+type AmbiguousModelError struct {
+	Name       string
+	Candidates []string
+}
+
+func (e *AmbiguousModelError) Error() string {
+	return fmt.Sprintf("model name %q is ambiguous, candidates: %s", e.Name, strings.Join(e.Candidates, ", "))
+}
+
+// resolveModelName maps a client supplied model name to a full OpenRouter ID
+// from ids. Matches are tried in order of preference:
+//
+//  1. exact full ID ("openai/gpt-4o")
+//  2. exact short name, the part after the vendor ("gpt-4o")
+//  3. suffix of a full ID ("4o"), only if a single ID has that suffix
+//
+// Ollama clients append ":latest" to names without a tag, so if the name as
+// given does not match, it is retried without that tag. OpenRouter variant
+// tags such as ":free" are part of the ID and are matched literally.
+func resolveModelName(ids []string, name string) (string, error) {
+	id, err := matchModelName(ids, name)
+	if errors.Is(err, ErrModelNotFound) {
+		if base, found := strings.CutSuffix(name, ":latest"); found && base != "" {
+			id, err = matchModelName(ids, base)
+		}
+	}
+	if errors.Is(err, ErrModelNotFound) {
+		return "", fmt.Errorf("%w: %s", ErrModelNotFound, name)
+	}
+	return id, err
+}
+
+func matchModelName(ids []string, name string) (string, error) {
+	if name == "" {
+		return "", ErrModelNotFound
+	}
+
+	for _, id := range ids {
+		if id == name {
+			return id, nil
+		}
+	}
+
+	var shortMatches []string
+	for _, id := range ids {
+		if shortModelName(id) == name {
+			shortMatches = append(shortMatches, id)
+		}
+	}
+	if id, err := uniqueMatch(name, shortMatches); id != "" || err != nil {
+		return id, err
+	}
+
+	var suffixMatches []string
+	for _, id := range ids {
+		if strings.HasSuffix(id, name) {
+			suffixMatches = append(suffixMatches, id)
+		}
+	}
+	if id, err := uniqueMatch(name, suffixMatches); id != "" || err != nil {
+		return id, err
+	}
+
+	return "", ErrModelNotFound
+}
+
+// uniqueMatch returns the only candidate, an ambiguity error for several, or
+// an empty result when there are none.
+func uniqueMatch(name string, candidates []string) (string, error) {
+	switch len(candidates) {
+	case 0:
+		return "", nil
+	case 1:
+		return candidates[0], nil
+	}
+
+	sorted := append([]string(nil), candidates...)
+	sort.Strings(sorted)
+	return "", &AmbiguousModelError{Name: name, Candidates: sorted}
+}
+
+// shortModelName strips the vendor prefix from a full model ID.
+func shortModelName(id string) string {
+	parts := strings.Split(id, "/")
+	return parts[len(parts)-1]
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResolveModelName(t *testing.T) {
+	catalog := []string{
+		"openai/gpt-4o",
+		"openai/gpt-4o-mini",
+		"openai/chatgpt-4o-latest",
+		"deepseek/deepseek-chat",
+		"deepseek/deepseek-chat-v3-0324:free",
+		"thirdparty/deepseek-chat",
+		"mistralai/mistral-large",
+		"meta-llama/llama-3-70b-instruct",
+	}
+
+	tests := []struct {
+		name       string
+		input      string
+		want       string
+		wantErr    error
+		candidates []string
+	}{
+		{name: "exact id", input: "openai/gpt-4o", want: "openai/gpt-4o"},
+		{name: "exact id wins over suffix", input: "openai/gpt-4o-mini", want: "openai/gpt-4o-mini"},
+		{name: "exact short name", input: "gpt-4o", want: "openai/gpt-4o"},
+		{name: "short name with openrouter tag", input: "deepseek-chat-v3-0324:free", want: "deepseek/deepseek-chat-v3-0324:free"},
+		{name: "unique suffix", input: "large", want: "mistralai/mistral-large"},
+		{name: "latest tag on short name", input: "mistral-large:latest", want: "mistralai/mistral-large"},
+		{name: "latest tag on full id", input: "openai/gpt-4o:latest", want: "openai/gpt-4o"},
+		{name: "latest tag kept when part of the id", input: "chatgpt-4o-latest", want: "openai/chatgpt-4o-latest"},
+		{name: "exact id with duplicate short name", input: "thirdparty/deepseek-chat", want: "thirdparty/deepseek-chat"},
+		{
+			name:       "ambiguous short name",
+			input:      "deepseek-chat",
+			wantErr:    &AmbiguousModelError{},
+			candidates: []string{"deepseek/deepseek-chat", "thirdparty/deepseek-chat"},
+		},
+		{
+			name:       "ambiguous suffix",
+			input:      "chat",
+			wantErr:    &AmbiguousModelError{},
+			candidates: []string{"deepseek/deepseek-chat", "thirdparty/deepseek-chat"},
+		},
+		{name: "unknown", input: "gemini-pro", wantErr: ErrModelNotFound},
+		{name: "unknown with latest tag", input: "gemini-pro:latest", wantErr: ErrModelNotFound},
+		{name: "empty", input: "", wantErr: ErrModelNotFound},
+		{name: "bare latest tag", input: ":latest", wantErr: ErrModelNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveModelName(catalog, tt.input)
+
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("resolveModelName(%q) returned error: %v", tt.input, err)
+				}
+				if got != tt.want {
+					t.Fatalf("resolveModelName(%q) = %q, want %q", tt.input, got, tt.want)
+				}
+			case *AmbiguousModelError:
+				var ambiguous *AmbiguousModelError
+				if !errors.As(err, &ambiguous) {
+					t.Fatalf("resolveModelName(%q) error = %v, want ambiguity error", tt.input, err)
+				}
+				if !reflect.DeepEqual(ambiguous.Candidates, tt.candidates) {
+					t.Fatalf("candidates = %v, want %v", ambiguous.Candidates, tt.candidates)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Fatalf("resolveModelName(%q) error = %v, want %v", tt.input, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveModelNameIgnoresCatalogOrder(t *testing.T) {
+	forward := []string{"a/x-chat", "b/y-chat"}
+	backward := []string{"b/y-chat", "a/x-chat"}
+
+	for _, catalog := range [][]string{forward, backward} {
+		var ambiguous *AmbiguousModelError
+		if _, err := resolveModelName(catalog, "chat"); !errors.As(err, &ambiguous) {
+			t.Fatalf("catalog %v: error = %v, want ambiguity error", catalog, err)
+		}
+		if want := []string{"a/x-chat", "b/y-chat"}; !reflect.DeepEqual(ambiguous.Candidates, want) {
+			t.Fatalf("catalog %v: candidates = %v, want %v", catalog, ambiguous.Candidates, want)
+		}
+	}
+}
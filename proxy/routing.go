@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// providerOption is the Ollama options key clients use to send provider
+// preferences for a single request.
+const providerOption = "provider"
+
+// ProviderPreferences is OpenRouter's provider routing object, sent as the
+// "provider" field of a chat completion. Unset fields leave the choice to
+// OpenRouter.
+type ProviderPreferences struct {
+	// Order lists providers to try first, in order.
+	Order []string `json:"order,omitempty"`
+	// AllowFallbacks set to false stops OpenRouter from trying providers
+	// outside Order.
+	AllowFallbacks *bool `json:"allow_fallbacks,omitempty"`
+	// RequireParameters routes only to providers supporting every
+	// parameter of the request.
+	RequireParameters *bool `json:"require_parameters,omitempty"`
+	// DataCollection set to "deny" excludes providers that store or train
+	// on prompts.
+	DataCollection string `json:"data_collection,omitempty"`
+	// Only and Ignore restrict the providers that may serve the request.
+	Only   []string `json:"only,omitempty"`
+	Ignore []string `json:"ignore,omitempty"`
+	// Quantizations restricts providers to these quantization levels, such
+	// as "fp8" or "int4".
+	Quantizations []string `json:"quantizations,omitempty"`
+	// Sort orders providers by "price", "throughput" or "latency".
+	Sort string `json:"sort,omitempty"`
+}
+
+// IsZero reports whether no preference is set.
+func (p ProviderPreferences) IsZero() bool {
+	return len(p.Order) == 0 && p.AllowFallbacks == nil && p.RequireParameters == nil &&
+		p.DataCollection == "" && len(p.Only) == 0 && len(p.Ignore) == 0 &&
+		len(p.Quantizations) == 0 && p.Sort == ""
+}
+
+func (p ProviderPreferences) validate() error {
+	switch p.DataCollection {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("data_collection must be \"allow\" or \"deny\", got %q", p.DataCollection)
+	}
+	switch p.Sort {
+	case "", "price", "throughput", "latency":
+	default:
+		return fmt.Errorf("sort must be \"price\", \"throughput\" or \"latency\", got %q", p.Sort)
+	}
+	return nil
+}
+
+// merge returns p with every field set in override replacing its own, except
+// that a data_collection of "deny" cannot be relaxed.
+func (p ProviderPreferences) merge(override ProviderPreferences) ProviderPreferences {
+	if override.Order != nil {
+		p.Order = override.Order
+	}
+	if override.AllowFallbacks != nil {
+		p.AllowFallbacks = override.AllowFallbacks
+	}
+	if override.RequireParameters != nil {
+		p.RequireParameters = override.RequireParameters
+	}
+	if override.DataCollection != "" && p.DataCollection != "deny" {
+		p.DataCollection = override.DataCollection
+	}
+	if override.Only != nil {
+		p.Only = override.Only
+	}
+	if override.Ignore != nil {
+		p.Ignore = override.Ignore
+	}
+	if override.Quantizations != nil {
+		p.Quantizations = override.Quantizations
+	}
+	if override.Sort != "" {
+		p.Sort = override.Sort
+	}
+	return p
+}
+
+// restrict returns p narrowed by a request's own preferences. A request may
+// reorder and sort providers, but never reach one p excludes: only and
+// quantizations are intersected with p's, ignore is added to p's, and
+// allow_fallbacks, require_parameters and a data_collection of "deny" can
+// only be tightened. Order is limited to p's order when p disallows
+// fallbacks, since the order then decides which providers are tried.
+func (p ProviderPreferences) restrict(request ProviderPreferences) ProviderPreferences {
+	noFallbacks := p.AllowFallbacks != nil && !*p.AllowFallbacks
+	if noFallbacks && len(p.Order) > 0 {
+		p.Order = narrow(p.Order, request.Order)
+	} else if len(request.Order) > 0 {
+		p.Order = request.Order
+	}
+	if request.AllowFallbacks != nil && !noFallbacks {
+		p.AllowFallbacks = request.AllowFallbacks
+	}
+	if request.RequireParameters != nil && (p.RequireParameters == nil || !*p.RequireParameters) {
+		p.RequireParameters = request.RequireParameters
+	}
+	if request.DataCollection != "" && p.DataCollection != "deny" {
+		p.DataCollection = request.DataCollection
+	}
+	p.Only = narrow(p.Only, request.Only)
+	p.Quantizations = narrow(p.Quantizations, request.Quantizations)
+	for _, provider := range request.Ignore {
+		if !slices.Contains(p.Ignore, provider) {
+			p.Ignore = append(slices.Clip(p.Ignore), provider)
+		}
+	}
+	if request.Sort != "" {
+		p.Sort = request.Sort
+	}
+	return p
+}
+
+// narrow returns the entries of requested that allowed permits, in the
+// request's order. An empty allowed permits anything. If nothing requested is
+// permitted allowed is returned, as an empty list would lift the restriction
+// instead of keeping it.
+func narrow(allowed, requested []string) []string {
+	if len(requested) == 0 {
+		return allowed
+	}
+	if len(allowed) == 0 {
+		return requested
+	}
+	var kept []string
+	for _, entry := range requested {
+		if slices.Contains(allowed, entry) {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		return allowed
+	}
+	return kept
+}
+
+// ProviderRouting holds provider preferences for all requests and for
+// individual models, keyed by full OpenRouter model ID.
+type ProviderRouting struct {
+	Default ProviderPreferences            `json:"default"`
+	Models  map[string]ProviderPreferences `json:"models"`
+}
+
+// LoadProviderRouting reads a routing file of the form
+//
+//	{"default": {"data_collection": "deny"},
+//	 "models": {"meta-llama/llama-3-70b-instruct": {"order": ["groq"], "sort": "throughput"}}}
+func LoadProviderRouting(path string) (*ProviderRouting, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routing ProviderRouting
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&routing); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := routing.Default.validate(); err != nil {
+		return nil, fmt.Errorf("%s: default: %w", path, err)
+	}
+	for model, prefs := range routing.Models {
+		if err := prefs.validate(); err != nil {
+			return nil, fmt.Errorf("%s: model %s: %w", path, model, err)
+		}
+	}
+	return &routing, nil
+}
+
+// preferences returns the preferences for a request to model: the defaults,
+// overridden by the model's entry and then restricted by the request's own.
+// A nil routing applies only the request's preferences.
+func (r *ProviderRouting) preferences(model string, options map[string]interface{}) ProviderPreferences {
+	var prefs ProviderPreferences
+	if r != nil {
+		prefs = r.Default.merge(r.Models[model])
+	}
+	// Requests are validated by the handlers, so errors cannot occur here
+	if override, err := requestPreferences(options); err == nil {
+		prefs = prefs.restrict(override)
+	}
+	return prefs
+}
+
+// requestPreferences decodes the provider preferences a client sent in the
+// "provider" option.
+func requestPreferences(options map[string]interface{}) (ProviderPreferences, error) {
+	var prefs ProviderPreferences
+	raw, ok := options[providerOption]
+	if !ok || raw == nil {
+		return prefs, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return prefs, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&prefs); err != nil {
+		return prefs, fmt.Errorf("invalid %s option: %w", providerOption, err)
+	}
+	if err := prefs.validate(); err != nil {
+		return prefs, fmt.Errorf("invalid %s option: %w", providerOption, err)
+	}
+	return prefs, nil
+}
+
+// checkProviderOption rejects a malformed "provider" option with a 400. It
+// returns false if the request was rejected.
+func checkProviderOption(c *gin.Context, options map[string]interface{}) bool {
+	if _, err := requestPreferences(options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+type bodyFieldsContextKey struct{}
+
+// withBodyFields returns a context whose upstream requests get fields added
+// to their JSON body, for parameters go-openai has no field for. Fields
+// already carried by ctx are kept unless fields replaces them.
+func withBodyFields(ctx context.Context, fields map[string]interface{}) context.Context {
+	merged := make(map[string]interface{})
+	if existing, ok := ctx.Value(bodyFieldsContextKey{}).(map[string]interface{}); ok {
+		for key, value := range existing {
+			merged[key] = value
+		}
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, bodyFieldsContextKey{}, merged)
+}
+
+// addBodyFields merges the fields carried by the request context into its
+// JSON body.
+func addBodyFields(req *http.Request) error {
+	fields, _ := req.Context().Value(bodyFieldsContextKey{}).(map[string]interface{})
+	if len(fields) == 0 || req.Body == nil {
+		return nil
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	// Keep the other fields as raw JSON so numbers such as seeds survive
+	// unchanged
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data, &body); err != nil {
+		return fmt.Errorf("adding fields to request body: %w", err)
+	}
+	for key, value := range fields {
+		if body[key], err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+	if data, err = json.Marshal(body); err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProviderPreferencesMerge(t *testing.T) {
+	no := false
+	base := ProviderPreferences{Order: []string{"azure"}, DataCollection: "deny", Sort: "latency"}
+	got := base.merge(ProviderPreferences{Order: []string{"openai"}, AllowFallbacks: &no, DataCollection: "allow"})
+	want := ProviderPreferences{Order: []string{"openai"}, AllowFallbacks: &no, DataCollection: "deny", Sort: "latency"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merge = %+v, want %+v", got, want)
+	}
+
+	if got := (ProviderPreferences{}).merge(ProviderPreferences{DataCollection: "allow"}); got.DataCollection != "allow" {
+		t.Errorf("data_collection = %q, want allow", got.DataCollection)
+	}
+}
+
+func TestProviderPreferencesRestrict(t *testing.T) {
+	yes, no := true, false
+	admin := ProviderPreferences{
+		Only:              []string{"azure", "openai"},
+		Ignore:            []string{"deepinfra"},
+		Quantizations:     []string{"fp8"},
+		RequireParameters: &yes,
+		DataCollection:    "deny",
+	}
+	for _, tc := range []struct {
+		name    string
+		admin   ProviderPreferences
+		request ProviderPreferences
+		want    ProviderPreferences
+	}{
+		{"empty request", admin, ProviderPreferences{}, admin},
+		{"only is intersected", admin, ProviderPreferences{Only: []string{"openai", "together"}},
+			ProviderPreferences{Only: []string{"openai"}, Ignore: []string{"deepinfra"}, Quantizations: []string{"fp8"}, RequireParameters: &yes, DataCollection: "deny"}},
+		{"only outside the admin's is dropped", admin, ProviderPreferences{Only: []string{"together"}}, admin},
+		{"only without an admin list", ProviderPreferences{}, ProviderPreferences{Only: []string{"together"}}, ProviderPreferences{Only: []string{"together"}}},
+		{"ignore is added to", admin, ProviderPreferences{Ignore: []string{"azure", "deepinfra"}},
+			ProviderPreferences{Only: []string{"azure", "openai"}, Ignore: []string{"deepinfra", "azure"}, Quantizations: []string{"fp8"}, RequireParameters: &yes, DataCollection: "deny"}},
+		{"empty ignore keeps the admin's", admin, ProviderPreferences{Ignore: []string{}}, admin},
+		{"quantizations are intersected", admin, ProviderPreferences{Quantizations: []string{"int4"}}, admin},
+		{"loosening is refused", admin, ProviderPreferences{RequireParameters: &no, DataCollection: "allow"}, admin},
+		{"tightening is kept", ProviderPreferences{}, ProviderPreferences{AllowFallbacks: &no, RequireParameters: &yes, DataCollection: "deny"},
+			ProviderPreferences{AllowFallbacks: &no, RequireParameters: &yes, DataCollection: "deny"}},
+		{"order and sort replace", ProviderPreferences{Order: []string{"azure"}, Sort: "price"}, ProviderPreferences{Order: []string{"openai"}, Sort: "latency"},
+			ProviderPreferences{Order: []string{"openai"}, Sort: "latency"}},
+		{"order is limited without fallbacks", ProviderPreferences{Order: []string{"groq", "together"}, AllowFallbacks: &no},
+			ProviderPreferences{Order: []string{"together", "openai"}, AllowFallbacks: &yes},
+			ProviderPreferences{Order: []string{"together"}, AllowFallbacks: &no}},
+	} {
+		if got := tc.admin.restrict(tc.request); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: restrict = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+	if len(admin.Ignore) != 1 {
+		t.Errorf("restrict changed the admin's ignore list: %v", admin.Ignore)
+	}
+}
+
+func TestLoadProviderRouting(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "routing.json")
+		os.WriteFile(path, []byte(content), 0o600)
+		return path
+	}
+
+	routing, err := LoadProviderRouting(write(`{"default": {"data_collection": "deny"}, "models": {"openai/gpt-4o": {"sort": "throughput", "quantizations": ["fp8"]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs := routing.preferences("openai/gpt-4o", nil)
+	if prefs.DataCollection != "deny" || prefs.Sort != "throughput" || len(prefs.Quantizations) != 1 {
+		t.Errorf("preferences = %+v", prefs)
+	}
+	if prefs := routing.preferences("openai/gpt-4o-mini", nil); prefs.Sort != "" || prefs.DataCollection != "deny" {
+		t.Errorf("preferences for another model = %+v", prefs)
+	}
+
+	for _, content := range []string{
+		`{"default": {"sort": "cheapest"}}`,
+		`{"models": {"openai/gpt-4o": {"data_collection": "maybe"}}}`,
+		`{"default": {"orders": ["azure"]}}`,
+	} {
+		if _, err := LoadProviderRouting(write(content)); err == nil {
+			t.Errorf("LoadProviderRouting(%s) succeeded", content)
+		}
+	}
+}
+
+func TestChatProviderRouting(t *testing.T) {
+	p := newTestProxy(t)
+	p.router.s.provider.SetRouting(&ProviderRouting{
+		Default: ProviderPreferences{DataCollection: "deny"},
+		Models:  map[string]ProviderPreferences{"openai/gpt-4o": {Order: []string{"azure", "openai"}}},
+	})
+
+	for _, stream := range []bool{false, true} {
+		w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+			"model":    "gpt-4o",
+			"stream":   stream,
+			"messages": []map[string]string{{"role": "user", "content": "hello"}},
+			"options": map[string]interface{}{
+				"seed":     7,
+				"provider": map[string]interface{}{"sort": "price", "data_collection": "allow"},
+			},
+		})
+		expectStatus(t, w, http.StatusOK)
+	}
+
+	for _, body := range p.upstream.Bodies() {
+		var prefs ProviderPreferences
+		if err := json.Unmarshal(body["provider"], &prefs); err != nil {
+			t.Fatalf("provider field %s: %v", body["provider"], err)
+		}
+		want := ProviderPreferences{Order: []string{"azure", "openai"}, DataCollection: "deny", Sort: "price"}
+		if !reflect.DeepEqual(prefs, want) {
+			t.Errorf("provider = %+v, want %+v", prefs, want)
+		}
+		if seed := string(body["seed"]); seed != "7" {
+			t.Errorf("seed = %s, lost while adding the provider field", seed)
+		}
+	}
+}
+
+func TestChatProviderOptionCannotWiden(t *testing.T) {
+	p := newTestProxy(t)
+	p.router.s.provider.SetRouting(&ProviderRouting{
+		Models: map[string]ProviderPreferences{"openai/gpt-4o": {Only: []string{"azure"}, Ignore: []string{"deepinfra"}}},
+	})
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "hello"}},
+		"options": map[string]interface{}{
+			"provider": map[string]interface{}{"only": []string{"openai"}, "ignore": []string{}},
+		},
+	})
+	expectStatus(t, w, http.StatusOK)
+
+	var prefs ProviderPreferences
+	if err := json.Unmarshal(p.upstream.Bodies()[0]["provider"], &prefs); err != nil {
+		t.Fatal(err)
+	}
+	want := ProviderPreferences{Only: []string{"azure"}, Ignore: []string{"deepinfra"}}
+	if !reflect.DeepEqual(prefs, want) {
+		t.Errorf("provider = %+v, want %+v", prefs, want)
+	}
+}
+
+func TestChatInvalidProviderOption(t *testing.T) {
+	p := newTestProxy(t)
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"messages": []map[string]string{{"role": "user", "content": "hello"}},
+		"options":  map[string]interface{}{"provider": map[string]interface{}{"sort": "fastest"}},
+	})
+	expectStatus(t, w, http.StatusBadRequest)
+	if msg, _ := decodeJSON(t, w)["error"].(string); !strings.Contains(msg, "invalid provider option") {
+		t.Errorf("error = %q", msg)
+	}
+	if n := len(p.upstream.Requests()); n != 0 {
+		t.Errorf("upstream got %d requests", n)
+	}
+}
@@ -0,0 +1,1379 @@
+// Package proxy serves the Ollama API on top of OpenRouter, so Ollama
+// clients can use OpenRouter models.
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// FilterSource supplies the model filter in effect for a request. A fixed
+// *ModelFilter and the file backed *FilterStore both implement it.
+type FilterSource interface {
+	Filter() *ModelFilter
+}
+
+// Options configures the optional features of the server. Nil fields
+// disable the feature.
+type Options struct {
+	// EnforceAllowlist rejects models that are missing from the OpenRouter
+	// catalog instead of forwarding the name upstream unchanged.
+	EnforceAllowlist bool
+
+	// Tokens requires clients to send one of its bearer tokens.
+	Tokens *TokenStore
+	// AllowLocalhost lets loopback clients skip authentication.
+	AllowLocalhost bool
+	// Passthrough lets clients send their own OpenRouter key.
+	Passthrough bool
+
+	Spend         *SpendStore
+	Budgets       *Budgets
+	AuditLog      *AuditLogger
+	Redactor      *Redactor
+	ResponseCache *ResponseCache
+	Limiter       *RateLimiter
+
+	// MaxBodyBytes caps the size of request bodies. Zero means no limit.
+	MaxBodyBytes int64
+	// MaxMessages caps the number of messages in a chat or generate
+	// request. Zero means no limit.
+	MaxMessages int
+	// MaxPromptChars caps the characters across all messages of a request.
+	// Zero means no limit.
+	MaxPromptChars int
+	// CORS sets which browser origins may call the proxy. Nil uses
+	// DefaultCORSConfig, which allows only local pages.
+	CORS *CORSConfig
+	// Context shortens conversations that exceed the model's context
+	// window instead of letting the upstream call fail.
+	Context *ContextConfig
+	// Tokenizers counts prompt tokens for context checks and the
+	// tokenize endpoints. Nil estimates the count for every model.
+	Tokenizers *Tokenizers
+	// ReadyTimeout bounds the upstream checks behind /readyz and
+	// ReadyCacheTTL is how long their result is reused. Zero selects 5s and
+	// 10s.
+	ReadyTimeout  time.Duration
+	ReadyCacheTTL time.Duration
+	// WriteTimeout bounds each write to the client, so a stream can run
+	// indefinitely while a client that stops reading is dropped. Zero
+	// means no deadline.
+	WriteTimeout time.Duration
+}
+
+// server holds the dependencies of the route handlers.
+type server struct {
+	provider         *OpenrouterProvider
+	filter           FilterSource
+	tracker          *modelTracker
+	enforceAllowlist bool
+	tokens           *TokenStore
+	allowLocal       bool
+	passthrough      bool
+	spend            *SpendStore
+	budgets          *Budgets
+	auditLog         *AuditLogger
+	redactor         *Redactor
+	responseCache    *ResponseCache
+	limiter          *RateLimiter
+	maxBodyBytes     int64
+	maxMessages      int
+	maxPromptChars   int
+	writeTimeout     time.Duration
+	cors             CORSConfig
+	readiness        *readinessProbe
+	contextWindow    *ContextConfig
+	tokenizers       *Tokenizers
+
+	streams streamSet
+	// costLookups tracks the background lookups of billed costs.
+	costLookups sync.WaitGroup
+
+	// sleep paces the simulated pull progress. Tests replace it to run fast.
+	sleep func(context.Context, time.Duration) error
+}
+
+// New returns a Handler serving the Ollama API backed by provider. Models
+// are checked against filter, which may be nil to allow every model.
+func New(provider *OpenrouterProvider, filter FilterSource, opts Options) *Handler {
+	s := newServer(provider, filter, opts)
+	return &Handler{Handler: s.handler(), s: s}
+}
+
+func newServer(provider *OpenrouterProvider, filter FilterSource, opts Options) *server {
+	if filter == nil {
+		filter = &ModelFilter{}
+	}
+	cors := DefaultCORSConfig()
+	if opts.CORS != nil {
+		cors = *opts.CORS
+	}
+	readiness := &readinessProbe{provider: provider, timeout: opts.ReadyTimeout, ttl: opts.ReadyCacheTTL}
+	if readiness.timeout <= 0 {
+		readiness.timeout = defaultReadyTimeout
+	}
+	if readiness.ttl <= 0 {
+		readiness.ttl = defaultReadyCacheTTL
+	}
+	return &server{
+		provider:         provider,
+		filter:           filter,
+		tracker:          newModelTracker(),
+		enforceAllowlist: opts.EnforceAllowlist,
+		tokens:           opts.Tokens,
+		allowLocal:       opts.AllowLocalhost,
+		passthrough:      opts.Passthrough,
+		spend:            opts.Spend,
+		budgets:          opts.Budgets,
+		auditLog:         opts.AuditLog,
+		redactor:         opts.Redactor,
+		responseCache:    opts.ResponseCache,
+		limiter:          opts.Limiter,
+		maxBodyBytes:     opts.MaxBodyBytes,
+		maxMessages:      opts.MaxMessages,
+		maxPromptChars:   opts.MaxPromptChars,
+		writeTimeout:     opts.WriteTimeout,
+		cors:             cors,
+		readiness:        readiness,
+		contextWindow:    opts.Context,
+		tokenizers:       opts.Tokenizers,
+		sleep:            sleepContext,
+	}
+}
+
+// acquireModel marks a model in use for /api/ps and returns the function
+// that releases it. Only catalog models are tracked, so made-up names that
+// are forwarded without the allowlist cannot pile up in the tracker.
+func (s *server) acquireModel(model Model, fullModelName string, keepAlive time.Duration) func() {
+	if _, known := s.provider.LookupModel(fullModelName); !known {
+		return func() {}
+	}
+	return s.tracker.Acquire(model, fullModelName, keepAlive)
+}
+
+// modelNotFound writes Ollama's error for a model that does not exist.
+func modelNotFound(c *gin.Context, model string) {
+	c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", model)})
+}
+
+// resolveModel maps a client supplied model name to a full OpenRouter ID and
+// checks it against the model filter. On failure it writes the error response
+// and returns false.
+func (s *server) resolveModel(c *gin.Context, name string) (string, Model, bool) {
+	fullModelName, err := s.provider.GetFullModelName(c.Request.Context(), name)
+	var ambiguous *AmbiguousModelError
+	switch {
+	case errors.As(err, &ambiguous):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", Model{}, false
+	case errors.Is(err, ErrModelNotFound):
+		if s.enforceAllowlist {
+			modelNotFound(c, name)
+			return "", Model{}, false
+		}
+		// Forward unknown names unchanged so models missing from the
+		// catalog can still be used directly.
+		fullModelName = name
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Model not found: " + err.Error()})
+		return "", Model{}, false
+	}
+
+	model, known := s.provider.LookupModel(fullModelName)
+	if !s.allowsModel(c, model, known) {
+		slog.Warn("Rejected model", "model", name, "fullModelName", fullModelName, "known", known)
+		modelNotFound(c, name)
+		return "", Model{}, false
+	}
+
+	c.Set(metricsModelKey, modelLabel(fullModelName, known))
+	auditRecord(c).ResolvedModel = fullModelName
+	return fullModelName, model, true
+}
+
+// clientName identifies the client for rate limiting: the authenticated user
+// or, without authentication, the client IP.
+func clientName(c *gin.Context) string {
+	if user := userFromContext(c); user != nil {
+		return user.Name
+	}
+	return c.ClientIP()
+}
+
+// acquireRateLimit reserves capacity for a request. On failure it writes
+// Ollama's error with a Retry-After header and returns false.
+func acquireRateLimit(c *gin.Context, limiter *RateLimiter, fullModelName string, promptTokens int, stream bool) (func(used int), bool) {
+	release, err := limiter.Acquire(clientName(c), fullModelName, promptTokens, stream)
+	if err != nil {
+		var limitErr *RateLimitError
+		if errors.As(err, &limitErr) {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(limitErr.RetryAfter.Seconds()))))
+		}
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return release, true
+}
+
+// allowsModel reports whether the client may use model: it must pass the
+// model filter and the user's allowlist, and be in the catalog when the
+// allowlist is enforced.
+func (s *server) allowsModel(c *gin.Context, model Model, known bool) bool {
+	return (known || !s.enforceAllowlist) && s.filter.Filter().Allows(model) && userAllows(c, model)
+}
+
+// applyBudget enforces spend budgets for the client. Once a budget is used
+// up, requests go to the fallback model if one is configured and the client
+// may use it; otherwise the error response is written and false returned.
+func (s *server) applyBudget(c *gin.Context, fullModelName string, model Model) (string, Model, bool) {
+	reason := s.budgetReason(c, fullModelName, model)
+	if reason == "" {
+		return fullModelName, model, true
+	}
+
+	if fallbackName := s.budgets.FallbackModel; fallbackName != "" && fallbackName != fullModelName {
+		// The fallback must be in the catalog and allowed like any model the
+		// client names itself
+		fallback, known := s.provider.LookupModel(fallbackName)
+		if known && s.allowsModel(c, fallback, known) {
+			slog.Warn("Budget exceeded, using fallback model", "reason", reason, "model", fullModelName, "fallback", fallbackName)
+			c.Set(metricsModelKey, fallbackName)
+			auditRecord(c).ResolvedModel = fallbackName
+			return fallbackName, fallback, true
+		}
+		slog.Warn("Budget exceeded and fallback model not allowed", "reason", reason, "model", fullModelName, "fallback", fallbackName, "known", known)
+	}
+
+	slog.Warn("Budget exceeded, rejecting request", "reason", reason, "model", fullModelName)
+	c.JSON(http.StatusPaymentRequired, gin.H{"error": reason})
+	return "", Model{}, false
+}
+
+// budgetReason returns why the client may not call model within its
+// budgets, or "" if it may.
+func (s *server) budgetReason(c *gin.Context, fullModelName string, model Model) string {
+	reason := s.budgets.Exceeded(s.spend, clientName(c))
+	if reason == "" && s.budgets != nil && !model.Pricing.Known && !s.provider.MaxPricing().Known {
+		// Without any price to estimate from, the request's cost could go
+		// unnoticed; refuse it rather than the whole budget period
+		reason = fmt.Sprintf("the cost of %s cannot be estimated, so budgets cannot be enforced for it", fullModelName)
+	}
+	return reason
+}
+
+// settleUsage releases the rate limit reservation and records the spend of a
+// finished request. Requests that never got a response record nothing.
+func (s *server) settleUsage(c *gin.Context, model Model, usage openai.Usage, generationID string, releaseLimit func(int)) {
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	releaseLimit(usage.TotalTokens)
+	if usage.TotalTokens == 0 {
+		return
+	}
+
+	audit := auditRecord(c)
+	audit.PromptTokens = usage.PromptTokens
+	audit.CompletionTokens = usage.CompletionTokens
+
+	label := c.GetString(metricsModelKey)
+	tokensTotal.WithLabelValues(label, "in").Add(float64(usage.PromptTokens))
+	tokensTotal.WithLabelValues(label, "out").Add(float64(usage.CompletionTokens))
+
+	s.recordSpend(c, model, usage, generationID)
+}
+
+// recordSpend records the cost of a request from the model's pricing when
+// the catalog fixes it. Other requests are charged an estimate at the
+// highest catalog prices, which is replaced in the background by what
+// OpenRouter billed for the generation once it is known.
+func (s *server) recordSpend(c *gin.Context, model Model, usage openai.Usage, generationID string) {
+	if s.spend == nil {
+		return
+	}
+	user := clientName(c)
+	if cost, known := requestCost(model, usage); known {
+		s.spend.Record(user, model.ID, usage, cost, false)
+		return
+	}
+
+	estimate, _ := requestCost(Model{Pricing: s.provider.MaxPricing()}, usage)
+	day := s.spend.Record(user, model.ID, usage, estimate, true)
+	if generationID == "" {
+		slog.Warn("Recording an estimated cost for a request without a generation ID", "model", model.ID, "user", user, "estimate", estimate)
+		return
+	}
+
+	// The client may be gone, but its request still has to be paid for
+	ctx := context.WithoutCancel(c.Request.Context())
+	s.costLookups.Add(1)
+	go func() {
+		defer s.costLookups.Done()
+		ctx, cancel := context.WithTimeout(ctx, generationCostTimeout)
+		defer cancel()
+		cost, err := s.provider.GenerationCost(ctx, generationID)
+		if err != nil {
+			slog.Warn("Error looking up generation cost, keeping the estimate", "model", model.ID, "generation", generationID, "estimate", estimate, "Error", err)
+			return
+		}
+		s.spend.Correct(day, user, model.ID, estimate, cost)
+	}()
+}
+
+// cacheFor returns the response cache to use for the request. Clients that
+// send their own OpenRouter key bypass it: the key is only proven valid once
+// OpenRouter accepts it, which a cache hit would skip.
+func (s *server) cacheFor(c *gin.Context) *ResponseCache {
+	if isPassthroughClient(c) {
+		return nil
+	}
+	return s.responseCache
+}
+
+// userAllows reports whether the authenticated user may use the model.
+func userAllows(c *gin.Context, model Model) bool {
+	user := userFromContext(c)
+	return user == nil || user.Models.Allows(model)
+}
+
+// handler builds the gin engine with the middleware and routes for s.
+func (s *server) handler() *gin.Engine {
+	r := gin.Default()
+	r.Use(metricsMiddleware())
+	r.Use(otelgin.Middleware(serviceName))
+	if s.writeTimeout > 0 {
+		r.Use(writeTimeoutMiddleware(s.writeTimeout))
+	}
+	r.Use(corsMiddleware(s.cors))
+	// Auditing comes before the body limit and authentication so requests
+	// they reject are logged too
+	if s.auditLog != nil {
+		r.Use(auditMiddleware(s.auditLog, "/api/chat", "/api/generate"))
+	}
+	if s.maxBodyBytes > 0 {
+		r.Use(bodyLimitMiddleware(s.maxBodyBytes))
+	}
+	if s.tokens != nil {
+		r.Use(authMiddleware(s.tokens, s.allowLocal, s.passthrough))
+	}
+	r.Use(upstreamKeyMiddleware(s.passthrough))
+
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "Ollama is running")
+	})
+	r.HEAD("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.GET("/api/tags", s.handleTags)
+	r.HEAD("/api/tags", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.POST("/api/show", s.handleShow)
+	r.HEAD("/api/show", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.POST("/api/generate", s.handleGenerate)
+	r.HEAD("/api/generate", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.GET("/api/version", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"version": "0.1.0",
+		})
+	})
+	r.HEAD("/api/version", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.GET("/api/ps", s.handlePS)
+	r.HEAD("/api/ps", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.POST("/api/pull", s.handlePull)
+	r.HEAD("/api/pull", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.POST("/api/copy", s.handleCopy)
+	r.HEAD("/api/copy", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.DELETE("/api/delete", s.handleDelete)
+	r.HEAD("/api/delete", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.POST("/api/chat", s.handleChat)
+	r.HEAD("/api/chat", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	r.POST("/api/tokenize", s.handleTokenize)
+	r.POST("/api/detokenize", s.handleDetokenize)
+
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/healthz", s.handleHealth)
+	r.GET("/readyz", s.handleReady)
+
+	admin := r.Group("/admin", adminOnly(s.tokens != nil, s.allowLocal))
+	admin.GET("/keys", s.handleAdminKeys)
+	admin.GET("/usage", s.handleAdminUsage)
+
+	return r
+}
+
+// handleTags lists the catalog models the client may use, in Ollama's format.
+func (s *server) handleTags(c *gin.Context) {
+	models, err := s.provider.GetModels(c.Request.Context())
+	if err != nil {
+		slog.Error("Error getting models", "Error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	filter := s.filter.Filter()
+	// Construct a new array of model objects with extra fields
+	newModels := make([]map[string]interface{}, 0, len(models))
+	for _, m := range models {
+		// Если фильтр пустой, значит пропускаем проверку и берём все модели
+		if !filter.Allows(m) || !userAllows(c, m) {
+			continue
+		}
+		newModels = append(newModels, map[string]interface{}{
+			"name":        m.Name,
+			"model":       m.Model,
+			"modified_at": m.ModifiedAt,
+			"size":        270898672,
+			"digest":      "9077fe9d2ae1a4a41a868836b56b8163731a8fe16621397028c2c76f838c6907",
+			"details":     m.Details,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"models": newModels})
+}
+
+// handleShow describes a model.
+func (s *server) handleShow(c *gin.Context) {
+	var request map[string]string
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	modelName := request["model"] // Fixed: was "name", should be "model"
+	if modelName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model name is required"})
+		return
+	}
+
+	if _, _, ok := s.resolveModel(c, modelName); !ok {
+		return
+	}
+
+	details, err := s.provider.GetModelDetails(c.Request.Context(), modelName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, details)
+}
+
+// handleGenerate completes a prompt, streaming by default.
+func (s *server) handleGenerate(c *gin.Context) {
+	var request struct {
+		Model     string                 `json:"model"`
+		Prompt    string                 `json:"prompt"`
+		Stream    *bool                  `json:"stream"`
+		Format    interface{}            `json:"format"`
+		Options   map[string]interface{} `json:"options"`
+		System    string                 `json:"system"`
+		Template  string                 `json:"template"`
+		Raw       bool                   `json:"raw"`
+		Context   []int                  `json:"context"`
+		KeepAlive interface{}            `json:"keep_alive"`
+	}
+
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	keepAlive, err := parseKeepAlive(request.KeepAlive)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Convert prompt to messages format
+	messages := []openai.ChatCompletionMessage{}
+	if request.System != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: request.System,
+		})
+	}
+	messages = append(messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: request.Prompt,
+	})
+
+	if !s.checkPromptLimits(c, messages) || !checkProviderOption(c, request.Options) {
+		return
+	}
+	messages, redactions := s.redactor.Redact(messages)
+
+	audit := auditRecord(c)
+	audit.RequestedModel = request.Model
+	audit.Options = request.Options
+	audit.MessageCount = len(messages)
+	audit.Messages = messages
+	audit.Redactions = redactions.Counts()
+
+	// Get full model name
+	fullModelName, model, ok := s.resolveModel(c, request.Model)
+	if !ok {
+		return
+	}
+
+	// Handle empty prompt (load or unload model)
+	if request.Prompt == "" && request.System == "" {
+		doneReason := "load"
+		if keepAlive == 0 {
+			s.tracker.Unload(fullModelName)
+			doneReason = "unload"
+		} else {
+			// Loading is a request that ends at once, starting the
+			// keep_alive countdown
+			s.acquireModel(model, fullModelName, keepAlive)()
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"model":       request.Model,
+			"created_at":  time.Now().Format(time.RFC3339),
+			"response":    "",
+			"done":        true,
+			"done_reason": doneReason,
+		})
+		return
+	}
+
+	// Determine streaming (default true for /api/generate)
+	streamRequested := true
+	if request.Stream != nil {
+		streamRequested = *request.Stream
+	}
+	audit.Stream = streamRequested
+
+	fullModelName, model, ok = s.applyBudget(c, fullModelName, model)
+	if !ok {
+		return
+	}
+	// Track the model actually used, after any budget fallback
+	release := s.acquireModel(model, fullModelName, keepAlive)
+	defer release()
+
+	// Cached replies are served before the rate limit is taken: they cost
+	// nothing upstream, so limiting them would protect nothing
+	cacheKey := s.cacheFor(c).Key(fullModelName, messages, request.Options)
+	if cached, ok := s.responseCache.Get(cacheKey); ok {
+		audit.Cached = true
+		audit.FinishReason = cached.FinishReason
+		audit.Response = cached.Content
+		replayCached(c, cached, streamRequested, redactions, func(content string, done bool) gin.H {
+			body := gin.H{
+				"model":      fullModelName,
+				"created_at": time.Now().Format(time.RFC3339),
+				"response":   content,
+			}
+			if done {
+				body["context"] = []int{1, 2, 3} // Stub context
+			}
+			return body
+		})
+		return
+	}
+	if cacheKey != "" {
+		c.Header("X-Cache", "miss")
+	}
+
+	messages, promptTokens, ok := s.fitContext(c, model, messages, request.Options)
+	if !ok {
+		return
+	}
+	// Audit what is sent upstream rather than what the client sent;
+	// ContextDropped tells how many messages were cut
+	audit.Messages = messages
+
+	releaseLimit, ok := acquireRateLimit(c, s.limiter, fullModelName, promptTokens, streamRequested)
+	if !ok {
+		return
+	}
+	var usage openai.Usage
+	var generationID string
+	defer func() { s.settleUsage(c, model, usage, generationID, releaseLimit) }()
+
+	if !streamRequested {
+		// Non-streaming response
+		response, err := s.provider.Chat(c.Request.Context(), messages, fullModelName, request.Options)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		responseContent := ""
+		if len(response.Choices) > 0 {
+			responseContent = response.Choices[0].Message.Content
+			audit.FinishReason = string(response.Choices[0].FinishReason)
+		}
+		audit.Response = responseContent
+		if audit.FinishReason == "" {
+			audit.FinishReason = "stop"
+		}
+		usage = response.Usage
+		generationID = response.ID
+		if usage.TotalTokens == 0 {
+			usage.PromptTokens = promptTokens
+			usage.CompletionTokens = s.tokenizers.For(fullModelName).Count(responseContent)
+		}
+		s.responseCache.Put(cacheKey, &CachedResponse{Content: responseContent, FinishReason: audit.FinishReason, Usage: usage})
+
+		c.JSON(http.StatusOK, gin.H{
+			"model":                fullModelName,
+			"created_at":           time.Now().Format(time.RFC3339),
+			"response":             redactions.Restore(responseContent),
+			"done":                 true,
+			"done_reason":          audit.FinishReason,
+			"context":              []int{1, 2, 3}, // Stub context
+			"total_duration":       0,
+			"load_duration":        0,
+			"prompt_eval_count":    usage.PromptTokens,
+			"prompt_eval_duration": 0,
+			"eval_count":           usage.CompletionTokens,
+			"eval_duration":        0,
+		})
+		return
+	}
+
+	// Streaming response
+	ctx, endStream := s.streams.start(c.Request.Context())
+	defer endStream()
+	stream, err := s.provider.ChatStream(ctx, messages, fullModelName, request.Options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer stream.Close()
+
+	metrics := startStreamMetrics(c)
+	defer metrics.Done()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	w := c.Writer
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("Expected http.ResponseWriter to be an http.Flusher")
+		return
+	}
+
+	var lastFinishReason string
+	var completion strings.Builder
+	var chunks []string
+	restore := redactions.Stream()
+
+	relaySpan := startRelaySpan(c.Request.Context(), fullModelName)
+	var relayErr error
+	defer func() { endRelaySpan(relaySpan, usage, lastFinishReason, relayErr) }()
+
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			err = streamError(ctx, err)
+			slog.Error("Backend stream error", "Error", err)
+			relayErr = err
+			audit.Error = err.Error()
+			audit.Response = completion.String()
+			if usage.TotalTokens == 0 {
+				// The stream broke off before its usage arrived; charge
+				// the prompt and what was streamed so far
+				usage.PromptTokens = promptTokens
+				usage.CompletionTokens = s.tokenizers.For(fullModelName).Count(completion.String())
+			}
+			errorMsg := map[string]string{"error": "Stream error: " + err.Error()}
+			errorJson, _ := json.Marshal(errorMsg)
+			fmt.Fprintf(w, "%s\n", string(errorJson))
+			flusher.Flush()
+			return
+		}
+
+		if response.ID != "" {
+			generationID = response.ID
+		}
+		if response.Usage != nil {
+			usage = *response.Usage
+		}
+		if len(response.Choices) == 0 {
+			// The final chunk only carries usage
+			continue
+		}
+		if response.Choices[0].FinishReason != "" {
+			lastFinishReason = string(response.Choices[0].FinishReason)
+		}
+		completion.WriteString(response.Choices[0].Delta.Content)
+		if cacheKey != "" && response.Choices[0].Delta.Content != "" {
+			chunks = append(chunks, response.Choices[0].Delta.Content)
+		}
+		metrics.Chunk(response.Choices[0].Delta.Content)
+
+		responseJSON := map[string]interface{}{
+			"model":      fullModelName,
+			"created_at": time.Now().Format(time.RFC3339),
+			"response":   restore.Next(response.Choices[0].Delta.Content),
+			"done":       false,
+		}
+
+		jsonData, err := json.Marshal(responseJSON)
+		if err != nil {
+			slog.Error("Error marshaling response JSON", "Error", err)
+			return
+		}
+
+		fmt.Fprintf(w, "%s\n", string(jsonData))
+		flusher.Flush()
+	}
+
+	if rest := restore.Flush(); rest != "" {
+		jsonData, _ := json.Marshal(map[string]interface{}{
+			"model":      fullModelName,
+			"created_at": time.Now().Format(time.RFC3339),
+			"response":   rest,
+			"done":       false,
+		})
+		fmt.Fprintf(w, "%s\n", string(jsonData))
+	}
+
+	// Final response
+	if lastFinishReason == "" {
+		lastFinishReason = "stop"
+	}
+	audit.FinishReason = lastFinishReason
+	audit.Response = completion.String()
+	if usage.TotalTokens == 0 {
+		usage.PromptTokens = promptTokens
+		usage.CompletionTokens = s.tokenizers.For(fullModelName).Count(completion.String())
+	}
+	s.responseCache.Put(cacheKey, &CachedResponse{Content: completion.String(), Chunks: chunks, FinishReason: lastFinishReason, Usage: usage})
+
+	finalResponse := map[string]interface{}{
+		"model":                fullModelName,
+		"created_at":           time.Now().Format(time.RFC3339),
+		"response":             "",
+		"done":                 true,
+		"done_reason":          lastFinishReason,
+		"context":              []int{1, 2, 3}, // Stub context
+		"total_duration":       0,
+		"load_duration":        0,
+		"prompt_eval_count":    usage.PromptTokens,
+		"prompt_eval_duration": 0,
+		"eval_count":           usage.CompletionTokens,
+		"eval_duration":        0,
+	}
+
+	finalJsonData, err := json.Marshal(finalResponse)
+	if err != nil {
+		slog.Error("Error marshaling final response JSON", "Error", err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", string(finalJsonData))
+	flusher.Flush()
+}
+
+// handlePS lists the models loaded by clients.
+func (s *server) handlePS(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"models": s.tracker.List(),
+	})
+}
+
+// handlePull accepts a pull for any available model and simulates the download progress.
+func (s *server) handlePull(c *gin.Context) {
+	var request map[string]interface{}
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	modelName, ok := request["model"].(string)
+	if !ok || modelName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model name is required"})
+		return
+	}
+
+	// Check if streaming is requested (default true for pull)
+	streamRequested := true
+	if stream, exists := request["stream"]; exists {
+		if streamBool, ok := stream.(bool); ok {
+			streamRequested = streamBool
+		}
+	}
+
+	// Validate model exists in OpenRouter
+	if _, _, ok := s.resolveModel(c, modelName); !ok {
+		return
+	}
+
+	if !streamRequested {
+		// Non-streaming response
+		c.JSON(http.StatusOK, gin.H{
+			"status": "success",
+		})
+		return
+	}
+
+	// Streaming response - simulate download progress
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	w := c.Writer
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		return
+	}
+
+	ctx, endStream := s.streams.start(c.Request.Context())
+	defer endStream()
+	// wait paces the progress; when the client leaves or the server shuts
+	// down it ends the stream with an error chunk.
+	wait := func(d time.Duration) bool {
+		if err := s.sleep(ctx, d); err != nil {
+			errorJson, _ := json.Marshal(gin.H{"error": err.Error()})
+			fmt.Fprintf(w, "%s\n", string(errorJson))
+			flusher.Flush()
+			return false
+		}
+		return true
+	}
+
+	// Simulate realistic pull progress for a large model
+	// Step 1: Pulling manifest
+	manifestStep := map[string]interface{}{"status": "pulling manifest"}
+	jsonData, _ := json.Marshal(manifestStep)
+	fmt.Fprintf(w, "%s\n", string(jsonData))
+	flusher.Flush()
+	if !wait(2 * time.Second) {
+		return
+	}
+
+	// Step 2: Multiple layers with realistic sizes (simulating a 7B model ~4GB)
+	layers := []struct {
+		digest string
+		size   int64
+	}{
+		{"sha256:6a0746a1ec1aef3e7ec53868f220ff6e389f6f8ef87a01d77c96807de94ca2aa", 1073741824}, // 1GB
+		{"sha256:4fa551d4f938f68b8c1e6aedf7c5d35c5c5f5c5c5c5c5c5c5c5c5c5c5c5c5c5", 2147483648},  // 2GB
+		{"sha256:8ab4849b038cf2ad1f725cd8ad45c7b4f3c3c3c3c3c3c3c3c3c3c3c3c3c3c3", 536870912},    // 512MB
+		{"sha256:577073ffcc6ce95b3ac4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4c4", 268435456},    // 256MB
+		{"sha256:3f8eb4da87fa62c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2c2", 134217728},    // 128MB
+	}
+
+	for _, layer := range layers {
+		// Simulate downloading each layer with progress updates
+		chunkSize := layer.size / 20 // 20 progress updates per layer
+		for completed := int64(0); completed < layer.size; completed += chunkSize {
+			if completed+chunkSize > layer.size {
+				completed = layer.size
+			}
+
+			progressStep := map[string]interface{}{
+				"status":    "downloading",
+				"digest":    layer.digest,
+				"total":     layer.size,
+				"completed": completed,
+			}
+			jsonData, _ := json.Marshal(progressStep)
+			fmt.Fprintf(w, "%s\n", string(jsonData))
+			flusher.Flush()
+
+			// Slower download simulation - 500ms per chunk
+			if !wait(500 * time.Millisecond) {
+				return
+			}
+		}
+	}
+
+	// Step 3: Verifying digests (slower)
+	verifyStep := map[string]interface{}{"status": "verifying sha256 digest"}
+	jsonData, _ = json.Marshal(verifyStep)
+	fmt.Fprintf(w, "%s\n", string(jsonData))
+	flusher.Flush()
+	if !wait(3 * time.Second) {
+		return
+	}
+
+	// Step 4: Writing manifest
+	writeStep := map[string]interface{}{"status": "writing manifest"}
+	jsonData, _ = json.Marshal(writeStep)
+	fmt.Fprintf(w, "%s\n", string(jsonData))
+	flusher.Flush()
+	if !wait(2 * time.Second) {
+		return
+	}
+
+	// Step 5: Removing unused layers
+	removeStep := map[string]interface{}{"status": "removing any unused layers"}
+	jsonData, _ = json.Marshal(removeStep)
+	fmt.Fprintf(w, "%s\n", string(jsonData))
+	flusher.Flush()
+	if !wait(1 * time.Second) {
+		return
+	}
+
+	// Step 6: Success
+	successStep := map[string]interface{}{"status": "success"}
+	jsonData, _ = json.Marshal(successStep)
+	fmt.Fprintf(w, "%s\n", string(jsonData))
+	flusher.Flush()
+}
+
+// handleCopy accepts copies without doing anything; OpenRouter models cannot be copied.
+func (s *server) handleCopy(c *gin.Context) {
+	var request map[string]string
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	if request["source"] == "" || request["destination"] == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Source and destination are required"})
+		return
+	}
+
+	// Stub response - just return success
+	c.Status(http.StatusOK)
+}
+
+// handleDelete accepts deletes without doing anything; OpenRouter models cannot be deleted.
+func (s *server) handleDelete(c *gin.Context) {
+	var request map[string]string
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	if request["model"] == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model name is required"})
+		return
+	}
+
+	// Stub response - just return success
+	c.Status(http.StatusOK)
+}
+
+// handleChat answers a chat, streaming by default.
+func (s *server) handleChat(c *gin.Context) {
+	var request struct {
+		Model     string                         `json:"model"`
+		Messages  []openai.ChatCompletionMessage `json:"messages"`
+		Stream    *bool                          `json:"stream"`
+		Format    interface{}                    `json:"format"`
+		Options   map[string]interface{}         `json:"options"`
+		Tools     []interface{}                  `json:"tools"`
+		KeepAlive interface{}                    `json:"keep_alive"`
+	}
+
+	// Parse the JSON request
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	keepAlive, err := parseKeepAlive(request.KeepAlive)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Determine streaming (default true for /api/chat)
+	streamRequested := true
+	if request.Stream != nil {
+		streamRequested = *request.Stream
+	}
+
+	if !s.checkPromptLimits(c, request.Messages) || !checkProviderOption(c, request.Options) {
+		return
+	}
+	messages, redactions := s.redactor.Redact(request.Messages)
+
+	audit := auditRecord(c)
+	audit.RequestedModel = request.Model
+	audit.Options = request.Options
+	audit.Stream = streamRequested
+	audit.MessageCount = len(messages)
+	audit.Messages = messages
+	audit.Redactions = redactions.Counts()
+
+	// Handle empty messages array (load or unload model)
+	if len(request.Messages) == 0 {
+		doneReason := "load"
+		fullModelName, model, ok := s.resolveModel(c, request.Model)
+		if !ok {
+			return
+		}
+		if keepAlive == 0 {
+			s.tracker.Unload(fullModelName)
+			doneReason = "unload"
+		} else {
+			// Loading is a request that ends at once, starting the
+			// keep_alive countdown
+			s.acquireModel(model, fullModelName, keepAlive)()
+		}
+		if streamRequested {
+			c.JSON(http.StatusOK, gin.H{
+				"model":      request.Model,
+				"created_at": time.Now().Format(time.RFC3339),
+				"message": gin.H{
+					"role":    "assistant",
+					"content": "",
+				},
+				"done":        true,
+				"done_reason": doneReason,
+			})
+		} else {
+			c.JSON(http.StatusOK, gin.H{
+				"model":      request.Model,
+				"created_at": time.Now().Format(time.RFC3339),
+				"message": gin.H{
+					"role":    "assistant",
+					"content": "",
+				},
+				"done":        true,
+				"done_reason": doneReason,
+			})
+		}
+		return
+	}
+
+	// Get full model name
+	fullModelName, model, ok := s.resolveModel(c, request.Model)
+	if !ok {
+		return
+	}
+
+	fullModelName, model, ok = s.applyBudget(c, fullModelName, model)
+	if !ok {
+		return
+	}
+	// Track the model actually used, after any budget fallback
+	release := s.acquireModel(model, fullModelName, keepAlive)
+	defer release()
+
+	// Cached replies are served before the rate limit is taken: they cost
+	// nothing upstream, so limiting them would protect nothing
+	cacheKey := s.cacheFor(c).Key(fullModelName, messages, request.Options)
+	if cached, ok := s.responseCache.Get(cacheKey); ok {
+		audit.Cached = true
+		audit.FinishReason = cached.FinishReason
+		audit.Response = cached.Content
+		replayCached(c, cached, streamRequested, redactions, func(content string, done bool) gin.H {
+			return gin.H{
+				"model":      fullModelName,
+				"created_at": time.Now().Format(time.RFC3339),
+				"message": gin.H{
+					"role":    "assistant",
+					"content": content,
+				},
+			}
+		})
+		return
+	}
+	if cacheKey != "" {
+		c.Header("X-Cache", "miss")
+	}
+
+	messages, promptTokens, ok := s.fitContext(c, model, messages, request.Options)
+	if !ok {
+		return
+	}
+	// Audit what is sent upstream rather than what the client sent;
+	// ContextDropped tells how many messages were cut
+	audit.Messages = messages
+
+	releaseLimit, ok := acquireRateLimit(c, s.limiter, fullModelName, promptTokens, streamRequested)
+	if !ok {
+		return
+	}
+	var usage openai.Usage
+	var generationID string
+	defer func() { s.settleUsage(c, model, usage, generationID, releaseLimit) }()
+
+	// Handle non-streaming response
+	if !streamRequested {
+		response, err := s.provider.Chat(c.Request.Context(), messages, fullModelName, request.Options)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		responseContent := ""
+		if len(response.Choices) > 0 {
+			responseContent = response.Choices[0].Message.Content
+			audit.FinishReason = string(response.Choices[0].FinishReason)
+		}
+		audit.Response = responseContent
+		if audit.FinishReason == "" {
+			audit.FinishReason = "stop"
+		}
+		usage = response.Usage
+		generationID = response.ID
+		if usage.TotalTokens == 0 {
+			usage.PromptTokens = promptTokens
+			usage.CompletionTokens = s.tokenizers.For(fullModelName).Count(responseContent)
+		}
+		s.responseCache.Put(cacheKey, &CachedResponse{Content: responseContent, FinishReason: audit.FinishReason, Usage: usage})
+
+		c.JSON(http.StatusOK, gin.H{
+			"model":      fullModelName,
+			"created_at": time.Now().Format(time.RFC3339),
+			"message": gin.H{
+				"role":    "assistant",
+				"content": redactions.Restore(responseContent),
+			},
+			"done":                 true,
+			"done_reason":          audit.FinishReason,
+			"total_duration":       0,
+			"load_duration":        0,
+			"prompt_eval_count":    usage.PromptTokens,
+			"prompt_eval_duration": 0,
+			"eval_count":           usage.CompletionTokens,
+			"eval_duration":        0,
+		})
+		return
+	}
+
+	slog.Info("Requested model", "model", request.Model)
+	slog.Info("Using model", "fullModelName", fullModelName)
+
+	// Call ChatStream to get the stream
+	ctx, endStream := s.streams.start(c.Request.Context())
+	defer endStream()
+	stream, err := s.provider.ChatStream(ctx, messages, fullModelName, request.Options)
+	if err != nil {
+		slog.Error("Failed to create stream", "Error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer stream.Close() // Ensure stream closure
+
+	metrics := startStreamMetrics(c)
+	defer metrics.Done()
+
+	// --- ИСПРАВЛЕНИЯ для NDJSON (Ollama-style) ---
+
+	// Set headers CORRECTLY for Newline Delimited JSON
+	c.Writer.Header().Set("Content-Type", "application/x-ndjson") // <--- КЛЮЧЕВОЕ ИЗМЕНЕНИЕ
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	// Transfer-Encoding: chunked устанавливается Gin автоматически
+
+	w := c.Writer // Получаем ResponseWriter
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("Expected http.ResponseWriter to be an http.Flusher")
+		// Отправить ошибку клиенту уже сложно, т.к. заголовки могли уйти
+		return
+	}
+
+	var lastFinishReason string
+	var completion strings.Builder
+	var chunks []string
+	restore := redactions.Stream()
+
+	relaySpan := startRelaySpan(c.Request.Context(), fullModelName)
+	var relayErr error
+	defer func() { endRelaySpan(relaySpan, usage, lastFinishReason, relayErr) }()
+
+	// Stream responses back to the client
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			// End of stream from the backend provider
+			break
+		}
+		if err != nil {
+			err = streamError(ctx, err)
+			slog.Error("Backend stream error", "Error", err)
+			relayErr = err
+			audit.Error = err.Error()
+			audit.Response = completion.String()
+			if usage.TotalTokens == 0 {
+				// The stream broke off before its usage arrived; charge
+				// the prompt and what was streamed so far
+				usage.PromptTokens = promptTokens
+				usage.CompletionTokens = s.tokenizers.For(fullModelName).Count(completion.String())
+			}
+			// Попытка отправить ошибку в формате NDJSON
+			// Ollama обычно просто обрывает соединение или шлет 500 перед этим
+			errorMsg := map[string]string{"error": "Stream error: " + err.Error()}
+			errorJson, _ := json.Marshal(errorMsg)
+			fmt.Fprintf(w, "%s\n", string(errorJson)) // Отправляем ошибку + \n
+			flusher.Flush()
+			return
+		}
+
+		if response.ID != "" {
+			generationID = response.ID
+		}
+		if response.Usage != nil {
+			usage = *response.Usage
+		}
+		if len(response.Choices) == 0 {
+			// The final chunk only carries usage
+			continue
+		}
+
+		// Сохраняем причину остановки, если она есть в чанке
+		if response.Choices[0].FinishReason != "" {
+			lastFinishReason = string(response.Choices[0].FinishReason)
+		}
+		completion.WriteString(response.Choices[0].Delta.Content)
+		if cacheKey != "" && response.Choices[0].Delta.Content != "" {
+			chunks = append(chunks, response.Choices[0].Delta.Content)
+		}
+		metrics.Chunk(response.Choices[0].Delta.Content)
+
+		// Build JSON response structure for intermediate chunks (Ollama chat format)
+		responseJSON := map[string]interface{}{
+			"model":      fullModelName,
+			"created_at": time.Now().Format(time.RFC3339),
+			"message": map[string]string{
+				"role":    "assistant",
+				"content": restore.Next(response.Choices[0].Delta.Content), // Может быть ""
+			},
+			"done": false, // Всегда false для промежуточных чанков
+		}
+
+		// Marshal JSON
+		jsonData, err := json.Marshal(responseJSON)
+		if err != nil {
+			slog.Error("Error marshaling intermediate response JSON", "Error", err)
+			return // Прерываем, так как не можем отправить данные
+		}
+
+		// Send JSON object followed by a newline
+		fmt.Fprintf(w, "%s\n", string(jsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON (JSON + \n)
+
+		// Flush data to send it immediately
+		flusher.Flush()
+	}
+
+	if rest := restore.Flush(); rest != "" {
+		jsonData, _ := json.Marshal(map[string]interface{}{
+			"model":      fullModelName,
+			"created_at": time.Now().Format(time.RFC3339),
+			"message": map[string]string{
+				"role":    "assistant",
+				"content": rest,
+			},
+			"done": false,
+		})
+		fmt.Fprintf(w, "%s\n", string(jsonData))
+	}
+
+	// --- Отправка финального сообщения (done: true) в стиле Ollama ---
+
+	// Определяем причину остановки (если бэкенд не дал, ставим 'stop')
+	// Ollama использует 'stop', 'length', 'content_filter', 'tool_calls'
+	if lastFinishReason == "" {
+		lastFinishReason = "stop"
+	}
+	audit.FinishReason = lastFinishReason
+	audit.Response = completion.String()
+	if usage.TotalTokens == 0 {
+		usage.PromptTokens = promptTokens
+		usage.CompletionTokens = s.tokenizers.For(fullModelName).Count(completion.String())
+	}
+	s.responseCache.Put(cacheKey, &CachedResponse{Content: completion.String(), Chunks: chunks, FinishReason: lastFinishReason, Usage: usage})
+
+	// ВАЖНО: Замените nil на 0 для числовых полей статистики
+	finalResponse := map[string]interface{}{
+		"model":      fullModelName,
+		"created_at": time.Now().Format(time.RFC3339),
+		"message": map[string]string{
+			"role":    "assistant",
+			"content": "", // Пустой контент для финального сообщения
+		},
+		"done":                 true,
+		"done_reason":          lastFinishReason,
+		"total_duration":       0,
+		"load_duration":        0,
+		"prompt_eval_count":    usage.PromptTokens, // <--- ИЗМЕНЕНО: nil заменен на 0
+		"prompt_eval_duration": 0,
+		"eval_count":           usage.CompletionTokens, // <--- ИЗМЕНЕНО: nil заменен на 0
+		"eval_duration":        0,
+	}
+
+	finalJsonData, err := json.Marshal(finalResponse)
+	if err != nil {
+		slog.Error("Error marshaling final response JSON", "Error", err)
+		return
+	}
+
+	// Отправляем финальный JSON-объект + newline
+	fmt.Fprintf(w, "%s\n", string(finalJsonData)) // <--- ИЗМЕНЕНО: Формат NDJSON
+	flusher.Flush()
+
+	// ВАЖНО: Для NDJSON НЕТ 'data: [DONE]' маркера.
+	// Клиент понимает конец потока по получению объекта с "done": true
+	// и/или по закрытию соединения сервером (что Gin сделает автоматически после выхода из хендлера).
+
+	// --- Конец исправлений ---
+}
+
+// handleAdminKeys reports the state of the OpenRouter key pool.
+func (s *server) handleAdminKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": s.provider.KeyStatus()})
+}
+
+// handleAdminUsage reports spend per day, user and model.
+func (s *server) handleAdminUsage(c *gin.Context) {
+	if s.spend == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "spend tracking is disabled, set USAGE_FILE to enable it"})
+		return
+	}
+
+	// Default to the current month
+	now := time.Now()
+	from := c.DefaultQuery("from", now.Format("2006-01")+"-01")
+	to := c.DefaultQuery("to", now.Format(dayFormat))
+	for _, day := range []string{from, to} {
+		if _, err := time.Parse(dayFormat, day); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be dates in YYYY-MM-DD format"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, s.spend.Report(from, to, c.Query("user")))
+}
@@ -0,0 +1,773 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	os.Exit(m.Run())
+}
+
+// testProxy is the proxy's handler wired to a fake OpenRouter.
+type testProxy struct {
+	upstream *fakeOpenRouter
+	router   *Handler
+}
+
+// newTestProxy starts a fake upstream and builds the handler. configure may
+// enable optional features before the handler is built.
+func newTestProxy(t *testing.T, configure ...func(*Options)) *testProxy {
+	t.Helper()
+	return newFilteredTestProxy(t, nil, configure...)
+}
+
+// newFilteredTestProxy is newTestProxy with the models checked against
+// filter.
+func newFilteredTestProxy(t *testing.T, filter FilterSource, configure ...func(*Options)) *testProxy {
+	t.Helper()
+	upstream := newFakeOpenRouter(t)
+	keys, err := ParseKeyPool("sk-or-test-key-0000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opts Options
+	for _, fn := range configure {
+		fn(&opts)
+	}
+	s := newServer(NewOpenrouterProvider(keys, upstream.URL), filter, opts)
+	s.sleep = func(context.Context, time.Duration) error { return nil }
+	return &testProxy{upstream: upstream, router: &Handler{Handler: s.handler(), s: s}}
+}
+
+// do sends a request from localhost and returns the recorded response.
+func (p *testProxy) do(t *testing.T, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	return p.doAs(t, "", method, path, body)
+}
+
+// doAs sends a request from localhost with token as its bearer token, if
+// not empty.
+func (p *testProxy) doAs(t *testing.T, token, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.RemoteAddr = "127.0.0.1:50000"
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	return w
+}
+
+// decodeJSON decodes a single JSON object response.
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+	}
+	return body
+}
+
+// decodeNDJSON decodes a newline delimited JSON response.
+func decodeNDJSON(t *testing.T, w *httptest.ResponseRecorder) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, want, w.Body.String())
+	}
+}
+
+func TestRoot(t *testing.T) {
+	p := newTestProxy(t)
+	w := p.do(t, http.MethodGet, "/", nil)
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "Ollama is running" {
+		t.Errorf("body = %q", w.Body.String())
+	}
+}
+
+func TestHeadRoutes(t *testing.T) {
+	p := newTestProxy(t)
+	for _, path := range []string{"/", "/api/tags", "/api/show", "/api/generate", "/api/version", "/api/ps", "/api/pull", "/api/copy", "/api/delete", "/api/chat"} {
+		if w := p.do(t, http.MethodHead, path, nil); w.Code != http.StatusOK {
+			t.Errorf("HEAD %s = %d", path, w.Code)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	p := newTestProxy(t)
+	req := httptest.NewRequest(http.MethodOptions, "/api/chat", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	expectStatus(t, w, http.StatusNoContent)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	p := newTestProxy(t)
+	w := p.do(t, http.MethodGet, "/api/version", nil)
+	expectStatus(t, w, http.StatusOK)
+	if decodeJSON(t, w)["version"] == "" {
+		t.Error("missing version")
+	}
+}
+
+func TestTags(t *testing.T) {
+	p := newTestProxy(t)
+	w := p.do(t, http.MethodGet, "/api/tags", nil)
+	expectStatus(t, w, http.StatusOK)
+
+	models := decodeJSON(t, w)["models"].([]interface{})
+	if len(models) != len(defaultFakeModels) {
+		t.Fatalf("got %d models, want %d", len(models), len(defaultFakeModels))
+	}
+	first := models[0].(map[string]interface{})
+	if first["name"] != "gpt-4o" || first["details"] == nil {
+		t.Errorf("unexpected model entry: %v", first)
+	}
+}
+
+func TestTagsUpstreamError(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.Close()
+	w := p.do(t, http.MethodGet, "/api/tags", nil)
+	expectStatus(t, w, http.StatusInternalServerError)
+	if decodeJSON(t, w)["error"] == nil {
+		t.Error("missing error")
+	}
+}
+
+func TestShow(t *testing.T) {
+	p := newTestProxy(t)
+	w := p.do(t, http.MethodPost, "/api/show", map[string]string{"model": "gpt-4o-mini"})
+	expectStatus(t, w, http.StatusOK)
+
+	body := decodeJSON(t, w)
+	info := body["model_info"].(map[string]interface{})
+	if info["llama.context_length"] != 8192.0 {
+		t.Errorf("context length = %v", info["llama.context_length"])
+	}
+	if !strings.Contains(body["modelfile"].(string), "openai/gpt-4o-mini") {
+		t.Errorf("modelfile = %v", body["modelfile"])
+	}
+
+	expectStatus(t, p.do(t, http.MethodPost, "/api/show", map[string]string{}), http.StatusBadRequest)
+}
+
+func TestShowAmbiguousModel(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.models = []string{"openai/gpt-4o", "azure/gpt-4o"}
+	w := p.do(t, http.MethodPost, "/api/show", map[string]string{"model": "gpt-4o"})
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestPull(t *testing.T) {
+	p := newTestProxy(t)
+
+	w := p.do(t, http.MethodPost, "/api/pull", map[string]interface{}{"model": "gpt-4o", "stream": false})
+	expectStatus(t, w, http.StatusOK)
+	if decodeJSON(t, w)["status"] != "success" {
+		t.Errorf("body = %s", w.Body.String())
+	}
+
+	w = p.do(t, http.MethodPost, "/api/pull", map[string]interface{}{"model": "gpt-4o"})
+	expectStatus(t, w, http.StatusOK)
+	lines := decodeNDJSON(t, w)
+	if lines[0]["status"] != "pulling manifest" || lines[len(lines)-1]["status"] != "success" {
+		t.Errorf("unexpected pull progress: first %v, last %v", lines[0], lines[len(lines)-1])
+	}
+
+	expectStatus(t, p.do(t, http.MethodPost, "/api/pull", map[string]interface{}{}), http.StatusBadRequest)
+}
+
+func TestPullUnknownModelWithAllowlist(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) { o.EnforceAllowlist = true })
+	w := p.do(t, http.MethodPost, "/api/pull", map[string]interface{}{"model": "no-such-model", "stream": false})
+	expectStatus(t, w, http.StatusNotFound)
+}
+
+func TestModelFilterEnforced(t *testing.T) {
+	filter, err := ParseModelFilter(strings.NewReader("openai/*\n!gpt-4o-mini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newFilteredTestProxy(t, filter, func(o *Options) { o.EnforceAllowlist = true })
+
+	w := p.do(t, http.MethodGet, "/api/tags", nil)
+	expectStatus(t, w, http.StatusOK)
+	models := decodeJSON(t, w)["models"].([]interface{})
+	if len(models) != 1 || models[0].(map[string]interface{})["name"] != "gpt-4o" {
+		t.Errorf("listed models = %v, want only gpt-4o", models)
+	}
+
+	for _, tc := range []struct {
+		model string
+		want  int
+	}{
+		{"gpt-4o", http.StatusOK},
+		{"openai/gpt-4o", http.StatusOK},
+		{"gpt-4o-mini", http.StatusNotFound},                     // excluded
+		{"meta-llama/llama-3-70b-instruct", http.StatusNotFound}, // not included
+		{"openai/made-up", http.StatusNotFound},                  // not in the catalog
+	} {
+		chat := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+			"model":    tc.model,
+			"stream":   false,
+			"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		})
+		if chat.Code != tc.want {
+			t.Errorf("chat with %s: status = %d, want %d", tc.model, chat.Code, tc.want)
+		}
+		generate := p.do(t, http.MethodPost, "/api/generate", map[string]interface{}{"model": tc.model, "prompt": "hi", "stream": false})
+		if generate.Code != tc.want {
+			t.Errorf("generate with %s: status = %d, want %d", tc.model, generate.Code, tc.want)
+		}
+	}
+	if got := len(p.upstream.Requests()); got != 4 {
+		t.Errorf("upstream got %d requests, want only the 4 allowed", got)
+	}
+}
+
+func TestCopyAndDelete(t *testing.T) {
+	p := newTestProxy(t)
+	expectStatus(t, p.do(t, http.MethodPost, "/api/copy", map[string]string{"source": "a", "destination": "b"}), http.StatusOK)
+	expectStatus(t, p.do(t, http.MethodPost, "/api/copy", map[string]string{"source": "a"}), http.StatusBadRequest)
+	expectStatus(t, p.do(t, http.MethodDelete, "/api/delete", map[string]string{"model": "a"}), http.StatusOK)
+	expectStatus(t, p.do(t, http.MethodDelete, "/api/delete", map[string]string{}), http.StatusBadRequest)
+}
+
+func TestChatNonStreaming(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.Script(fakeResponse{Chunks: []string{"Hi", " there"}})
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "hello"}},
+		"options":  map[string]interface{}{"temperature": 0.5, "seed": 7, "num_predict": 64},
+	})
+	expectStatus(t, w, http.StatusOK)
+
+	body := decodeJSON(t, w)
+	message := body["message"].(map[string]interface{})
+	if message["content"] != "Hi there" || body["done"] != true || body["model"] != "openai/gpt-4o" {
+		t.Errorf("unexpected response: %v", body)
+	}
+	if body["prompt_eval_count"] != 10.0 || body["eval_count"] != 2.0 {
+		t.Errorf("usage = %v/%v", body["prompt_eval_count"], body["eval_count"])
+	}
+
+	reqs := p.upstream.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream got %d requests", len(reqs))
+	}
+	req := reqs[0]
+	if req.Model != "openai/gpt-4o" || req.Stream || req.Temperature != 0.5 || req.Seed == nil || *req.Seed != 7 || req.MaxTokens != 64 {
+		t.Errorf("unexpected upstream request: %+v", req)
+	}
+}
+
+func TestChatStreaming(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.Script(fakeResponse{Chunks: []string{"One", " two", " three"}, Delay: time.Millisecond})
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"messages": []map[string]string{{"role": "user", "content": "count"}},
+	})
+	expectStatus(t, w, http.StatusOK)
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	lines := decodeNDJSON(t, w)
+	var content strings.Builder
+	for _, line := range lines[:len(lines)-1] {
+		if line["done"] != false {
+			t.Errorf("intermediate chunk is done: %v", line)
+		}
+		content.WriteString(line["message"].(map[string]interface{})["content"].(string))
+	}
+	if content.String() != "One two three" {
+		t.Errorf("streamed content = %q", content.String())
+	}
+
+	final := lines[len(lines)-1]
+	if final["done"] != true || final["eval_count"] != 3.0 || final["prompt_eval_count"] != 10.0 {
+		t.Errorf("unexpected final chunk: %v", final)
+	}
+	if req := p.upstream.Requests()[0]; !req.Stream || req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+		t.Errorf("stream request without usage: %+v", req)
+	}
+}
+
+func TestChatStreamError(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.Script(fakeResponse{Chunks: []string{"partial", " answer", " lost"}, FailAfter: 1})
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+	})
+	lines := decodeNDJSON(t, w)
+	last := lines[len(lines)-1]
+	if last["error"] == nil {
+		t.Fatalf("stream did not end with an error: %v", lines)
+	}
+}
+
+func TestChatUpstreamError(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.Script(fakeResponse{Status: http.StatusBadGateway})
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+	})
+	expectStatus(t, w, http.StatusInternalServerError)
+	if decodeJSON(t, w)["error"] == nil {
+		t.Error("missing error")
+	}
+}
+
+func TestChatLoadAndUnload(t *testing.T) {
+	p := newTestProxy(t)
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{"model": "gpt-4o", "messages": []interface{}{}})
+	expectStatus(t, w, http.StatusOK)
+	if decodeJSON(t, w)["done_reason"] != "load" {
+		t.Errorf("body = %s", w.Body.String())
+	}
+
+	w = p.do(t, http.MethodGet, "/api/ps", nil)
+	expectStatus(t, w, http.StatusOK)
+	models := decodeJSON(t, w)["models"].([]interface{})
+	if len(models) != 1 || models[0].(map[string]interface{})["name"] != "gpt-4o" {
+		t.Fatalf("running models = %v", models)
+	}
+
+	w = p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{"model": "gpt-4o", "messages": []interface{}{}, "keep_alive": 0})
+	if decodeJSON(t, w)["done_reason"] != "unload" {
+		t.Errorf("body = %s", w.Body.String())
+	}
+	if models := decodeJSON(t, p.do(t, http.MethodGet, "/api/ps", nil))["models"].([]interface{}); len(models) != 0 {
+		t.Errorf("model still running after unload: %v", models)
+	}
+	if len(p.upstream.Requests()) != 0 {
+		t.Error("load and unload must not call upstream")
+	}
+}
+
+func TestChatInvalidJSON(t *testing.T) {
+	p := newTestProxy(t)
+	req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader("{"))
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestGenerateNonStreaming(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.Script(fakeResponse{Chunks: []string{"42"}})
+
+	w := p.do(t, http.MethodPost, "/api/generate", map[string]interface{}{
+		"model":  "gpt-4o",
+		"prompt": "meaning of life?",
+		"system": "be brief",
+		"stream": false,
+	})
+	expectStatus(t, w, http.StatusOK)
+	body := decodeJSON(t, w)
+	if body["response"] != "42" || body["done"] != true {
+		t.Errorf("unexpected response: %v", body)
+	}
+
+	req := p.upstream.Requests()[0]
+	if len(req.Messages) != 2 || req.Messages[0].Role != "system" || req.Messages[1].Content != "meaning of life?" {
+		t.Errorf("unexpected upstream messages: %+v", req.Messages)
+	}
+}
+
+func TestGenerateStreaming(t *testing.T) {
+	p := newTestProxy(t)
+	p.upstream.Script(fakeResponse{Chunks: []string{"a", "b", "c"}, FinishReason: "length"})
+
+	w := p.do(t, http.MethodPost, "/api/generate", map[string]interface{}{"model": "gpt-4o", "prompt": "abc"})
+	expectStatus(t, w, http.StatusOK)
+
+	lines := decodeNDJSON(t, w)
+	var content strings.Builder
+	for _, line := range lines {
+		content.WriteString(line["response"].(string))
+	}
+	if content.String() != "abc" {
+		t.Errorf("streamed content = %q", content.String())
+	}
+	if final := lines[len(lines)-1]; final["done"] != true {
+		t.Errorf("unexpected final chunk: %v", final)
+	}
+}
+
+func TestGenerateLoad(t *testing.T) {
+	p := newTestProxy(t)
+	w := p.do(t, http.MethodPost, "/api/generate", map[string]interface{}{"model": "gpt-4o"})
+	expectStatus(t, w, http.StatusOK)
+	if decodeJSON(t, w)["done_reason"] != "load" {
+		t.Errorf("body = %s", w.Body.String())
+	}
+}
+
+func TestGenerateResponseCache(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) {
+		o.ResponseCache = NewResponseCache(newMemoryCache(10), time.Hour)
+	})
+	p.upstream.Script(fakeResponse{Chunks: []string{"cached", " answer"}})
+
+	request := map[string]interface{}{"model": "gpt-4o", "prompt": "q", "options": map[string]interface{}{"temperature": 0}}
+	first := p.do(t, http.MethodPost, "/api/generate", request)
+	second := p.do(t, http.MethodPost, "/api/generate", request)
+	if first.Header().Get("X-Cache") != "miss" || second.Header().Get("X-Cache") != "hit" {
+		t.Fatalf("X-Cache = %q, %q", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"))
+	}
+	if len(p.upstream.Requests()) != 1 {
+		t.Errorf("upstream got %d requests, want 1", len(p.upstream.Requests()))
+	}
+
+	var replayed strings.Builder
+	for _, line := range decodeNDJSON(t, second) {
+		replayed.WriteString(line["response"].(string))
+	}
+	if replayed.String() != "cached answer" {
+		t.Errorf("replayed %q", replayed.String())
+	}
+}
+
+func TestChatRedaction(t *testing.T) {
+	p := newTestProxy(t, func(o *Options) {
+		o.Redactor, _ = NewRedactor([]string{"email"}, nil)
+		o.Redactor.Restore = true
+	})
+	p.upstream.Script(fakeResponse{Chunks: []string{"Mail [REDACTED", "_EMAIL_1] now"}})
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"messages": []map[string]string{{"role": "user", "content": "my address is bob@example.com"}},
+	})
+	expectStatus(t, w, http.StatusOK)
+
+	if sent := p.upstream.Requests()[0].Messages[0].Content; strings.Contains(sent, "bob@example.com") {
+		t.Errorf("email sent upstream: %q", sent)
+	}
+	var content strings.Builder
+	for _, line := range decodeNDJSON(t, w) {
+		content.WriteString(line["message"].(map[string]interface{})["content"].(string))
+	}
+	if content.String() != "Mail bob@example.com now" {
+		t.Errorf("restored content = %q", content.String())
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(tokensFile, []byte(`[
+		{"token": "secret-token", "user": "alice", "models": ["gpt-4o-mini"]},
+		{"token": "disabled-token", "user": "bob", "disabled": true}
+	]`), 0o600)
+	tokens, err := LoadTokenStore(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, func(o *Options) { o.Tokens = tokens })
+	chat := func(model string) map[string]interface{} {
+		return map[string]interface{}{
+			"model":    model,
+			"stream":   false,
+			"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		}
+	}
+
+	expectStatus(t, p.do(t, http.MethodGet, "/api/tags", nil), http.StatusUnauthorized)
+	expectStatus(t, p.doAs(t, "wrong-token", http.MethodGet, "/api/tags", nil), http.StatusUnauthorized)
+
+	w := p.doAs(t, "secret-token", http.MethodGet, "/api/tags", nil)
+	expectStatus(t, w, http.StatusOK)
+	if models := decodeJSON(t, w)["models"].([]interface{}); len(models) != 1 {
+		t.Errorf("user sees %d models, want 1", len(models))
+	}
+
+	// The user's models list applies to calls as well as the listing
+	expectStatus(t, p.doAs(t, "secret-token", http.MethodPost, "/api/chat", chat("gpt-4o-mini")), http.StatusOK)
+	expectStatus(t, p.doAs(t, "secret-token", http.MethodPost, "/api/chat", chat("gpt-4o")), http.StatusNotFound)
+	if got := len(p.upstream.Requests()); got != 1 {
+		t.Errorf("upstream got %d requests, want 1", got)
+	}
+
+	w = p.doAs(t, "disabled-token", http.MethodPost, "/api/chat", chat("gpt-4o-mini"))
+	expectStatus(t, w, http.StatusForbidden)
+	if !strings.Contains(w.Body.String(), "bob is disabled") {
+		t.Errorf("disabled user error = %s", w.Body.String())
+	}
+
+	// The file is read once at startup; later edits need a restart
+	os.WriteFile(tokensFile, []byte(`[{"token": "new-token", "user": "carol"}]`), 0o600)
+	expectStatus(t, p.doAs(t, "secret-token", http.MethodGet, "/api/tags", nil), http.StatusOK)
+	expectStatus(t, p.doAs(t, "new-token", http.MethodGet, "/api/tags", nil), http.StatusUnauthorized)
+}
+
+func TestLoadTokenStore(t *testing.T) {
+	for _, tc := range []struct {
+		name, content string
+	}{
+		{"not JSON", `{`},
+		{"missing token", `[{"user": "alice"}]`},
+		{"missing user", `[{"token": "t"}]`},
+		{"duplicate token", `[{"token": "t", "user": "alice"}, {"token": "t", "user": "bob"}]`},
+		{"bad models rule", `[{"token": "t", "user": "alice", "models": ["re:("]}]`},
+	} {
+		path := filepath.Join(t.TempDir(), "tokens.json")
+		os.WriteFile(path, []byte(tc.content), 0o600)
+		if _, err := LoadTokenStore(path); err == nil {
+			t.Errorf("%s: LoadTokenStore succeeded", tc.name)
+		}
+	}
+	if _, err := LoadTokenStore(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadTokenStore of a missing file succeeded")
+	}
+}
+
+func TestUpstreamKeys(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(tokensFile, []byte(`[
+		{"token": "alice-token", "user": "alice", "openrouter_key": "sk-or-alice-key-0000000000"},
+		{"token": "bob-token", "user": "bob"}
+	]`), 0o600)
+	tokens, err := LoadTokenStore(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, func(o *Options) {
+		o.Tokens = tokens
+		o.Passthrough = true
+		o.ResponseCache = NewResponseCache(newMemoryCache(10), time.Hour)
+	})
+	chat := map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+	}
+
+	for _, tc := range []struct {
+		token, want string
+	}{
+		{"alice-token", "sk-or-alice-key-0000000000"},
+		{"bob-token", "sk-or-test-key-0000000000"},
+		{"sk-or-v1-client-key", "sk-or-v1-client-key"},
+	} {
+		expectStatus(t, p.doAs(t, tc.token, http.MethodPost, "/api/chat", chat), http.StatusOK)
+		keys := p.upstream.Keys()
+		if got := keys[len(keys)-1]; got != tc.want {
+			t.Errorf("token %s: upstream key = %s, want %s", tc.token, got, tc.want)
+		}
+	}
+
+	// A pass-through key is only proven by OpenRouter accepting it, so it
+	// opens only routes that call upstream, and never the response cache
+	for _, path := range []string{"/api/tags", "/api/ps"} {
+		expectStatus(t, p.doAs(t, "sk-or-v1-made-up", http.MethodGet, path, nil), http.StatusUnauthorized)
+	}
+	for _, path := range []string{"/api/show", "/api/tokenize"} {
+		expectStatus(t, p.doAs(t, "sk-or-v1-made-up", http.MethodPost, path, map[string]interface{}{"model": "gpt-4o"}), http.StatusUnauthorized)
+	}
+
+	chat["options"] = map[string]interface{}{"temperature": 0}
+	expectStatus(t, p.doAs(t, "bob-token", http.MethodPost, "/api/chat", chat), http.StatusOK)
+	if w := p.doAs(t, "bob-token", http.MethodPost, "/api/chat", chat); w.Header().Get("X-Cache") != "hit" {
+		t.Fatalf("X-Cache = %q for a token user, want hit", w.Header().Get("X-Cache"))
+	}
+	before := len(p.upstream.Requests())
+	w := p.doAs(t, "sk-or-v1-made-up", http.MethodPost, "/api/chat", chat)
+	if w.Header().Get("X-Cache") != "" || len(p.upstream.Requests()) != before+1 {
+		t.Errorf("pass-through request served from the cache (X-Cache %q)", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestAuthAllowsLocalUnixSocket(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(tokensFile, []byte(`[{"token": "secret-token", "user": "alice"}]`), 0o600)
+	tokens, err := LoadTokenStore(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, func(o *Options) {
+		o.Tokens = tokens
+		o.AllowLocalhost = true
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+	req.RemoteAddr = "@"
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	expectStatus(t, w, http.StatusUnauthorized)
+
+	local := &net.UnixAddr{Name: "/run/ollama.sock", Net: "unix"}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+	w = httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	p := newTestProxy(t)
+	p.do(t, http.MethodGet, "/api/version", nil)
+
+	w := p.do(t, http.MethodGet, "/metrics", nil)
+	expectStatus(t, w, http.StatusOK)
+	if !strings.Contains(w.Body.String(), "ollama_proxy_requests_total") {
+		t.Error("request counter missing from /metrics")
+	}
+}
+
+func TestMetricsUnknownModelLabel(t *testing.T) {
+	p := newTestProxy(t)
+	for _, model := range []string{"gpt-4o", "vendor/made-up-1", "vendor/made-up-2"} {
+		expectStatus(t, p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+			"model":    model,
+			"stream":   false,
+			"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		}), http.StatusOK)
+	}
+
+	body := p.do(t, http.MethodGet, "/metrics", nil).Body.String()
+	if strings.Contains(body, "made-up") {
+		t.Error("client supplied model names appear as metric labels")
+	}
+	for _, want := range []string{`model="openai/gpt-4o"`, `model="other"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+}
+
+func TestAdminKeys(t *testing.T) {
+	p := newTestProxy(t)
+	w := p.do(t, http.MethodGet, "/admin/keys", nil)
+	expectStatus(t, w, http.StatusOK)
+	keys := decodeJSON(t, w)["keys"].([]interface{})
+	if len(keys) != 1 || strings.Contains(keys[0].(map[string]interface{})["key"].(string), "0000000000") {
+		t.Errorf("keys = %v", keys)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/keys", nil)
+	w = httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	expectStatus(t, w, http.StatusForbidden)
+}
+
+func TestAdminRequiresAdminToken(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(tokensFile, []byte(`[{"token": "user-token", "user": "alice"}, {"token": "admin-token", "user": "ops", "admin": true}]`), 0o600)
+	tokens, err := LoadTokenStore(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, allowLocal := range []bool{false, true} {
+		p := newTestProxy(t, func(o *Options) {
+			o.Tokens = tokens
+			o.Passthrough = true
+			o.AllowLocalhost = allowLocal
+		})
+		for _, tc := range []struct {
+			token string
+			want  int
+		}{
+			{"sk-or-v1-client-key", http.StatusUnauthorized},
+			{"user-token", http.StatusForbidden},
+			{"admin-token", http.StatusOK},
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/admin/keys", nil)
+			req.RemoteAddr = "127.0.0.1:50000"
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			w := httptest.NewRecorder()
+			p.router.ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Errorf("allowLocal=%v, token %s: status = %d, want %d", allowLocal, tc.token, w.Code, tc.want)
+			}
+		}
+
+		want := http.StatusUnauthorized
+		if allowLocal {
+			want = http.StatusOK
+		}
+		if w := p.do(t, http.MethodGet, "/admin/keys", nil); w.Code != want {
+			t.Errorf("allowLocal=%v, local request without a token: status = %d, want %d", allowLocal, w.Code, want)
+		}
+	}
+}
+
+func TestAdminUsage(t *testing.T) {
+	p := newTestProxy(t)
+	expectStatus(t, p.do(t, http.MethodGet, "/admin/usage", nil), http.StatusNotFound)
+
+	spend := openTestSpendStore(t)
+	p = newTestProxy(t, func(o *Options) { o.Spend = spend })
+	p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "gpt-4o",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+	})
+
+	w := p.do(t, http.MethodGet, "/admin/usage", nil)
+	expectStatus(t, w, http.StatusOK)
+	if !strings.Contains(w.Body.String(), "openai/gpt-4o") {
+		t.Errorf("usage report misses the request: %s", w.Body.String())
+	}
+	expectStatus(t, p.do(t, http.MethodGet, "/admin/usage?from=yesterday", nil), http.StatusBadRequest)
+}
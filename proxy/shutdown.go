@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errShuttingDown is the cause given to streams that are still running when
+// the server drains.
+var errShuttingDown = errors.New("server is shutting down")
+
+// Handler serves the Ollama API. Besides serving requests it can end the
+// streams still running when the process shuts down.
+type Handler struct {
+	http.Handler
+	s *server
+}
+
+// ActiveStreams returns the number of streaming responses in progress.
+func (h *Handler) ActiveStreams() int {
+	return h.s.streams.count()
+}
+
+// Drain ends all running streams: their upstream requests are cancelled and
+// each client gets a final error chunk. It returns once the streams have
+// finished or ctx is done. Call it when http.Server.Shutdown times out,
+// before closing the server.
+func (h *Handler) Drain(ctx context.Context) error {
+	return h.s.streams.drain(ctx)
+}
+
+// WaitCostLookups waits until the billed costs of finished requests have
+// been looked up and recorded, or ctx is done. Call it after the server has
+// shut down and before flushing the SpendStore.
+func (h *Handler) WaitCostLookups(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.s.costLookups.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// streamSet tracks the streaming responses in progress.
+type streamSet struct {
+	mu       sync.Mutex
+	next     int
+	cancels  map[int]context.CancelCauseFunc
+	draining bool
+}
+
+// start registers a stream. The returned context is cancelled with
+// errShuttingDown when the server drains; call done when the stream ends.
+func (ss *streamSet) start(parent context.Context) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.draining {
+		cancel(errShuttingDown)
+		return ctx, func() {}
+	}
+	if ss.cancels == nil {
+		ss.cancels = make(map[int]context.CancelCauseFunc)
+	}
+	id := ss.next
+	ss.next++
+	ss.cancels[id] = cancel
+
+	return ctx, func() {
+		ss.mu.Lock()
+		delete(ss.cancels, id)
+		ss.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+func (ss *streamSet) count() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.cancels)
+}
+
+func (ss *streamSet) drain(ctx context.Context) error {
+	ss.mu.Lock()
+	ss.draining = true
+	for _, cancel := range ss.cancels {
+		cancel(errShuttingDown)
+	}
+	ss.mu.Unlock()
+
+	// Streams write their final chunk and unregister once their upstream
+	// read fails, which is quick; poll rather than track a wait group.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for ss.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// streamError returns the error to report for a failed stream read,
+// preferring the shutdown cause over the bare "context canceled".
+func streamError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errShuttingDown) {
+		return cause
+	}
+	return err
+}
+
+// sleepContext waits for d, returning early with the context's cause if ctx
+// is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
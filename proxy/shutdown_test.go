@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainEndsRunningStreams(t *testing.T) {
+	for _, route := range []string{"/api/chat", "/api/pull"} {
+		t.Run(strings.TrimPrefix(route, "/api/"), func(t *testing.T) {
+			p := newTestProxy(t)
+			p.router.s.sleep = sleepContext
+			p.upstream.Script(fakeResponse{Chunks: strings.Split("a slow answer that never finishes in time", " "), Delay: time.Second})
+
+			body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`
+			req := httptest.NewRequest(http.MethodPost, route, bytes.NewBufferString(body))
+			w := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				p.router.ServeHTTP(w, req)
+				close(done)
+			}()
+
+			deadline := time.Now().Add(2 * time.Second)
+			for p.router.ActiveStreams() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("stream did not start")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := p.router.Drain(ctx); err != nil {
+				t.Fatal(err)
+			}
+			<-done
+
+			lines := decodeNDJSON(t, w)
+			last := lines[len(lines)-1]
+			if msg, _ := last["error"].(string); !strings.Contains(msg, "server is shutting down") {
+				t.Fatalf("last chunk = %v, want a shutdown error", last)
+			}
+			if p.router.ActiveStreams() != 0 {
+				t.Errorf("%d streams still active", p.router.ActiveStreams())
+			}
+		})
+	}
+}
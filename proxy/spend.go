@@ -0,0 +1,381 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const dayFormat = "2006-01-02"
+
+// UsageTotals accumulates requests, tokens and cost in USD.
+type UsageTotals struct {
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	// Estimated counts requests whose Cost is an estimate, as OpenRouter's
+	// bill for them is not known yet.
+	Estimated int64 `json:"estimated,omitempty"`
+}
+
+func (t *UsageTotals) add(other UsageTotals) {
+	t.Requests += other.Requests
+	t.PromptTokens += other.PromptTokens
+	t.CompletionTokens += other.CompletionTokens
+	t.Cost += other.Cost
+	t.Estimated += other.Estimated
+}
+
+// SpendStore accumulates usage per day, user and model and persists it to a
+// JSON file so totals survive restarts. Writes are batched: a request only
+// updates memory, and the file is rewritten at most once per spendSaveDelay.
+type SpendStore struct {
+	// Retention is how long daily totals are kept; older days are dropped
+	// when the file is written. Zero keeps them forever.
+	Retention time.Duration
+
+	mu   sync.Mutex
+	path string
+	// days maps day -> user -> model -> totals.
+	days      map[string]map[string]map[string]*UsageTotals
+	now       func() time.Time
+	dirty     bool // days has changes not yet written
+	scheduled bool // a save is pending
+
+	saveMu sync.Mutex // Serializes writes of the file
+}
+
+// spendSaveDelay is the longest time usage stays only in memory.
+const spendSaveDelay = time.Second
+
+// OpenSpendStore loads the usage file at path, starting empty if it does not
+// exist yet.
+func OpenSpendStore(path string) (*SpendStore, error) {
+	store := &SpendStore{
+		path: path,
+		days: make(map[string]map[string]map[string]*UsageTotals),
+		now:  time.Now,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.days); err != nil {
+		return nil, fmt.Errorf("parsing usage file: %w", err)
+	}
+	return store, nil
+}
+
+// requestCost computes the cost of a request from the model's pricing. It
+// returns false for models without fixed pricing.
+func requestCost(model Model, usage openai.Usage) (float64, bool) {
+	if !model.Pricing.Known {
+		return 0, false
+	}
+	return float64(usage.PromptTokens)*model.Pricing.Prompt + float64(usage.CompletionTokens)*model.Pricing.Completion, true
+}
+
+// Record adds a finished request to today's totals. cost is in USD; when
+// estimated is set it is counted as an estimate, to be settled with Correct.
+// It returns the day the request was counted on.
+func (s *SpendStore) Record(user, modelID string, usage openai.Usage, cost float64, estimated bool) string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := s.now().Format(dayFormat)
+	request := UsageTotals{
+		Requests:         1,
+		PromptTokens:     int64(usage.PromptTokens),
+		CompletionTokens: int64(usage.CompletionTokens),
+		Cost:             cost,
+	}
+	if estimated {
+		request.Estimated = 1
+	}
+	s.totals(day, user, modelID).add(request)
+	s.scheduleSave()
+	return day
+}
+
+// Correct replaces the estimated cost of a request recorded on day with the
+// cost OpenRouter billed.
+func (s *SpendStore) Correct(day, user, modelID string, estimate, cost float64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := s.totals(day, user, modelID)
+	totals.Cost += cost - estimate
+	totals.Estimated--
+	s.scheduleSave()
+}
+
+// totals returns the totals of user and model on day, creating them if
+// needed. s.mu must be held.
+func (s *SpendStore) totals(day, user, modelID string) *UsageTotals {
+	users, ok := s.days[day]
+	if !ok {
+		users = make(map[string]map[string]*UsageTotals)
+		s.days[day] = users
+	}
+	models, ok := users[user]
+	if !ok {
+		models = make(map[string]*UsageTotals)
+		users[user] = models
+	}
+	totals, ok := models[modelID]
+	if !ok {
+		totals = &UsageTotals{}
+		models[modelID] = totals
+	}
+	return totals
+}
+
+// scheduleSave marks the totals changed and schedules a write of the file if
+// none is pending. s.mu must be held.
+func (s *SpendStore) scheduleSave() {
+	s.dirty = true
+	if !s.scheduled {
+		s.scheduled = true
+		time.AfterFunc(spendSaveDelay, func() {
+			s.mu.Lock()
+			s.scheduled = false
+			s.mu.Unlock()
+			if err := s.Flush(); err != nil {
+				slog.Error("Error writing usage file", "Error", err)
+			}
+		})
+	}
+}
+
+// Flush writes pending usage to the file, dropping days past Retention. Call
+// it before the process exits.
+func (s *SpendStore) Flush() error {
+	if s == nil {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.Retention > 0 {
+		cutoff := s.now().Add(-s.Retention).Format(dayFormat)
+		for day := range s.days {
+			if day < cutoff {
+				delete(s.days, day)
+			}
+		}
+	}
+	data, err := json.Marshal(s.days)
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		// Try again with the next save
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see
+// it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".usage-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Spent returns the usage accumulated by user (or all users if empty) on the
+// days for which include returns true.
+func (s *SpendStore) Spent(user string, include func(day string) bool) UsageTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total UsageTotals
+	for day, users := range s.days {
+		if !include(day) {
+			continue
+		}
+		for name, models := range users {
+			if user != "" && name != user {
+				continue
+			}
+			for _, totals := range models {
+				total.add(*totals)
+			}
+		}
+	}
+	return total
+}
+
+// UsageReport aggregates usage between two days, inclusive.
+type UsageReport struct {
+	From    string                  `json:"from"`
+	To      string                  `json:"to"`
+	Total   UsageTotals             `json:"total"`
+	ByUser  map[string]*UsageTotals `json:"by_user"`
+	ByModel map[string]*UsageTotals `json:"by_model"`
+	ByDay   map[string]*UsageTotals `json:"by_day"`
+}
+
+// Report aggregates usage from..to (YYYY-MM-DD, inclusive), optionally for a
+// single user.
+func (s *SpendStore) Report(from, to, user string) UsageReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := UsageReport{
+		From:    from,
+		To:      to,
+		ByUser:  make(map[string]*UsageTotals),
+		ByModel: make(map[string]*UsageTotals),
+		ByDay:   make(map[string]*UsageTotals),
+	}
+	add := func(m map[string]*UsageTotals, key string, totals UsageTotals) {
+		if m[key] == nil {
+			m[key] = &UsageTotals{}
+		}
+		m[key].add(totals)
+	}
+
+	days := make([]string, 0, len(s.days))
+	for day := range s.days {
+		if day >= from && day <= to {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+
+	for _, day := range days {
+		for name, models := range s.days[day] {
+			if user != "" && name != user {
+				continue
+			}
+			for model, totals := range models {
+				report.Total.add(*totals)
+				add(report.ByUser, name, *totals)
+				add(report.ByModel, model, *totals)
+				add(report.ByDay, day, *totals)
+			}
+		}
+	}
+	return report
+}
+
+// Budget limits spend in USD. Zero disables a limit.
+type Budget struct {
+	DailyUSD   float64 `json:"daily_usd"`
+	MonthlyUSD float64 `json:"monthly_usd"`
+}
+
+// Budgets is the format of the budgets file:
+//
+//	{
+//	  "total": {"daily_usd": 50, "monthly_usd": 1000},
+//	  "default_user": {"daily_usd": 5},
+//	  "users": {"alice": {"daily_usd": 20, "monthly_usd": 200}},
+//	  "fallback_model": "meta-llama/llama-3.1-8b-instruct:free"
+//	}
+//
+// When a budget is exhausted, requests are sent to fallback_model if set and
+// rejected otherwise.
+type Budgets struct {
+	Total         Budget            `json:"total"`
+	DefaultUser   Budget            `json:"default_user"`
+	Users         map[string]Budget `json:"users"`
+	FallbackModel string            `json:"fallback_model"`
+}
+
+// LoadBudgets reads a JSON budgets file.
+func LoadBudgets(path string) (*Budgets, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var budgets Budgets
+	if err := json.Unmarshal(data, &budgets); err != nil {
+		return nil, fmt.Errorf("parsing budgets file: %w", err)
+	}
+	return &budgets, nil
+}
+
+// Exceeded returns a description of the first budget that user has used up,
+// or an empty string if there is budget left. Requests whose bill is not
+// known yet count at their estimated cost.
+func (b *Budgets) Exceeded(store *SpendStore, user string) string {
+	if b == nil || store == nil {
+		return ""
+	}
+
+	now := store.now()
+	today := now.Format(dayFormat)
+	month := now.Format("2006-01")
+	isToday := func(day string) bool { return day == today }
+	isThisMonth := func(day string) bool { return len(day) >= 7 && day[:7] == month }
+
+	userBudget, ok := b.Users[user]
+	if !ok {
+		userBudget = b.DefaultUser
+	}
+
+	checks := []struct {
+		name   string
+		limit  float64
+		user   string
+		period func(string) bool
+	}{
+		{"daily budget of " + user, userBudget.DailyUSD, user, isToday},
+		{"monthly budget of " + user, userBudget.MonthlyUSD, user, isThisMonth},
+		{"total daily budget", b.Total.DailyUSD, "", isToday},
+		{"total monthly budget", b.Total.MonthlyUSD, "", isThisMonth},
+	}
+	for _, check := range checks {
+		if check.limit <= 0 {
+			continue
+		}
+		spent := store.Spent(check.user, check.period)
+		if spent.Cost >= check.limit {
+			return fmt.Sprintf("%s exceeded (%.4f of %.2f USD)", check.name, spent.Cost, check.limit)
+		}
+	}
+	return ""
+}
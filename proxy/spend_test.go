@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// openTestSpendStore opens a store in a temporary directory. Pending writes
+// are flushed before the directory is removed, so no save races the cleanup.
+func openTestSpendStore(t *testing.T) *SpendStore {
+	t.Helper()
+	store, err := OpenSpendStore(filepath.Join(t.TempDir(), "usage.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Flush() })
+	return store
+}
+
+func TestSpendUsesGenerationCostForVariablePricing(t *testing.T) {
+	spend := openTestSpendStore(t)
+	budgets := &Budgets{DefaultUser: Budget{DailyUSD: 1}}
+	p := newTestProxy(t, func(o *Options) {
+		o.Spend = spend
+		o.Budgets = budgets
+	})
+	chat := func(model string, stream bool) {
+		t.Helper()
+		w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+			"model":    model,
+			"stream":   stream,
+			"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		})
+		expectStatus(t, w, http.StatusOK)
+		p.router.s.costLookups.Wait()
+	}
+	autoTotals := func() *UsageTotals {
+		return spend.Report("0000-00-00", "9999-99-99", "").ByModel["openrouter/auto"]
+	}
+
+	p.upstream.SetGeneration(0.25, 0)
+	chat("openrouter/auto", false)
+	chat("openrouter/auto", true)
+	if totals := autoTotals(); totals == nil || totals.Requests != 2 || totals.Cost != 0.5 || totals.Estimated != 0 {
+		t.Fatalf("openrouter/auto totals = %+v, want 2 requests costing 0.5", totals)
+	}
+
+	// Without a reported cost the estimate at the highest catalog price is
+	// kept: 10 prompt and 2 completion tokens at 0.000001 USD
+	p.upstream.SetGeneration(0, http.StatusInternalServerError)
+	chat("openrouter/auto", false)
+	totals := autoTotals()
+	if want := 0.5 + 12*0.000001; totals.Requests != 3 || math.Abs(totals.Cost-want) > 1e-12 || totals.Estimated != 1 {
+		t.Fatalf("openrouter/auto totals = %+v, want one request estimated, costing %v in all", totals, want)
+	}
+	// One unbilled request does not block the budget
+	chat("gpt-4o", false)
+}
+
+func TestBudgetRejectsRequestsWithoutAnyPrice(t *testing.T) {
+	// The only model has variable pricing, so there is no price to estimate
+	// a request's cost from
+	upstream := newFakeOpenRouter(t, "openrouter/auto")
+	keys, err := ParseKeyPool("sk-or-test-key-0000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(NewOpenrouterProvider(keys, upstream.URL), nil, Options{
+		Spend:   openTestSpendStore(t),
+		Budgets: &Budgets{DefaultUser: Budget{DailyUSD: 1}},
+	})
+	p := &testProxy{upstream: upstream, router: &Handler{Handler: s.handler(), s: s}}
+	expectStatus(t, p.do(t, http.MethodGet, "/api/tags", nil), http.StatusOK)
+
+	w := p.do(t, http.MethodPost, "/api/chat", map[string]interface{}{
+		"model":    "openrouter/auto",
+		"stream":   false,
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+	})
+	expectStatus(t, w, http.StatusPaymentRequired)
+	if !strings.Contains(w.Body.String(), "cannot be estimated") {
+		t.Errorf("budget error = %s", w.Body.String())
+	}
+	if len(upstream.Requests()) != 0 {
+		t.Error("request reached upstream")
+	}
+}
+
+func TestSpendCorrectEstimate(t *testing.T) {
+	store, _ := spendAt(t, "2025-03-15")
+	usage := openai.Usage{PromptTokens: 10, TotalTokens: 10}
+	day := store.Record("alice", "openrouter/auto", usage, 0.4, true)
+	store.Record("alice", "openrouter/auto", usage, 0.1, false)
+	store.Correct(day, "alice", "openrouter/auto", 0.4, 0.05)
+
+	totals := store.Report(day, day, "alice").Total
+	if totals.Requests != 2 || math.Abs(totals.Cost-0.15) > 1e-12 || totals.Estimated != 0 {
+		t.Errorf("totals = %+v, want 2 billed requests costing 0.15", totals)
+	}
+}
+
+func TestBudgetFallback(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(tokensFile, []byte(`[{"token": "alice-token", "user": "alice"}, {"token": "bob-token", "user": "bob", "models": ["gpt-4o"]}]`), 0o600)
+	tokens, err := LoadTokenStore(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := openTestSpendStore(t)
+	for _, user := range []string{"alice", "bob"} {
+		spend.Record(user, "openai/gpt-4o", openai.Usage{PromptTokens: 10, TotalTokens: 10}, 2, false)
+	}
+	p := newTestProxy(t, func(o *Options) {
+		o.Tokens = tokens
+		o.Spend = spend
+		o.Budgets = &Budgets{DefaultUser: Budget{DailyUSD: 1}, FallbackModel: "mistralai/mistral-7b-instruct:free"}
+	})
+	chat := func(token string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(map[string]interface{}{
+			"model":    "gpt-4o",
+			"stream":   false,
+			"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/chat", bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		p.router.ServeHTTP(w, req)
+		return w
+	}
+
+	// alice may use any model, so her request goes to the fallback
+	w := chat("alice-token")
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeJSON(t, w)["model"]; got != "mistralai/mistral-7b-instruct:free" {
+		t.Errorf("model = %v, want the fallback", got)
+	}
+	if requests := p.upstream.Requests(); len(requests) != 1 || requests[0].Model != "mistralai/mistral-7b-instruct:free" {
+		t.Errorf("upstream requests = %+v", requests)
+	}
+
+	// bob is restricted to gpt-4o, so the fallback is not open to him
+	w = chat("bob-token")
+	expectStatus(t, w, http.StatusPaymentRequired)
+	if len(p.upstream.Requests()) != 1 {
+		t.Error("bob's request reached upstream")
+	}
+}
+
+// spendAt returns an empty store whose clock reads day.
+func spendAt(t *testing.T, day string) (*SpendStore, func(day string)) {
+	t.Helper()
+	store := openTestSpendStore(t)
+	setDay := func(day string) {
+		now, err := time.Parse(dayFormat, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.now = func() time.Time { return now.Add(12 * time.Hour) }
+	}
+	setDay(day)
+	return store, setDay
+}
+
+func TestBudgetsExceeded(t *testing.T) {
+	budgets := &Budgets{
+		Total:       Budget{DailyUSD: 10, MonthlyUSD: 30},
+		DefaultUser: Budget{DailyUSD: 2},
+		Users:       map[string]Budget{"alice": {DailyUSD: 5, MonthlyUSD: 8}},
+	}
+	usage := openai.Usage{PromptTokens: 1, TotalTokens: 1}
+
+	for _, tc := range []struct {
+		name  string
+		spend map[string]map[string]float64 // day -> user -> cost
+		user  string
+		want  string // prefix of the reason, "" for none
+	}{
+		{"no spend", nil, "bob", ""},
+		{"default daily under", map[string]map[string]float64{"2025-03-15": {"bob": 1.5}}, "bob", ""},
+		{"default daily used up", map[string]map[string]float64{"2025-03-15": {"bob": 2}}, "bob", "daily budget of bob exceeded"},
+		{"own budget replaces the default", map[string]map[string]float64{"2025-03-15": {"alice": 3}}, "alice", ""},
+		{"own daily used up", map[string]map[string]float64{"2025-03-15": {"alice": 5}}, "alice", "daily budget of alice exceeded"},
+		{"yesterday rolls over", map[string]map[string]float64{"2025-03-14": {"bob": 9}}, "bob", ""},
+		{"monthly counts earlier days", map[string]map[string]float64{"2025-03-01": {"alice": 4}, "2025-03-14": {"alice": 4}}, "alice", "monthly budget of alice exceeded"},
+		{"last month rolls over", map[string]map[string]float64{"2025-02-28": {"alice": 7}}, "alice", ""},
+		{"total daily counts every user", map[string]map[string]float64{"2025-03-15": {"x": 1.9, "y": 1.9, "z": 1.9, "w": 1.9, "v": 1.9, "u": 1}}, "bob", "total daily budget exceeded"},
+		{"total monthly", map[string]map[string]float64{"2025-03-02": {"x": 9}, "2025-03-03": {"y": 9}, "2025-03-04": {"z": 9}, "2025-03-05": {"w": 3}}, "bob", "total monthly budget exceeded"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store, setDay := spendAt(t, "2025-03-15")
+			for day, users := range tc.spend {
+				setDay(day)
+				for user, cost := range users {
+					store.Record(user, "openai/gpt-4o", usage, cost, false)
+				}
+			}
+			setDay("2025-03-15")
+			got := budgets.Exceeded(store, tc.user)
+			if (tc.want == "" && got != "") || !strings.HasPrefix(got, tc.want) {
+				t.Errorf("Exceeded(%s) = %q, want %q", tc.user, got, tc.want)
+			}
+		})
+	}
+
+	var none *Budgets
+	store, _ := spendAt(t, "2025-03-15")
+	store.Record("bob", "openai/gpt-4o", usage, 100, false)
+	if got := none.Exceeded(store, "bob"); got != "" {
+		t.Errorf("nil budgets: Exceeded = %q", got)
+	}
+}
+
+func TestSpendFlushAndRetention(t *testing.T) {
+	store, setDay := spendAt(t, "2024-01-10")
+	store.Retention = 30 * 24 * time.Hour
+	usage := openai.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}
+	store.Record("alice", "openai/gpt-4o", usage, 0.5, false)
+	setDay("2024-03-01")
+	store.Record("alice", "openai/gpt-4o", usage, 0.25, false)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenSpendStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := reopened.Report("0000-00-00", "9999-99-99", "")
+	if report.Total.Requests != 1 || report.Total.Cost != 0.25 || report.ByDay["2024-03-01"] == nil {
+		t.Errorf("after flush the file holds %+v, want only 2024-03-01", report.Total)
+	}
+
+	// Nothing changed, so nothing is written
+	os.Remove(store.path)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.path); !os.IsNotExist(err) {
+		t.Error("a clean store rewrote the file")
+	}
+}
+
+func TestAbortedStreamIsCharged(t *testing.T) {
+	spend := openTestSpendStore(t)
+	p := newTestProxy(t, func(o *Options) { o.Spend = spend })
+	p.upstream.Script(fakeResponse{Chunks: []string{"Hello", " there", " and", " goodbye"}, Delay: 50 * time.Millisecond})
+	srv := httptest.NewServer(p.router)
+	defer srv.Close()
+
+	// The client hangs up after the first chunk, before usage arrives
+	ctx, cancel := context.WithCancel(context.Background())
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/chat", strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	resp.Body.Close()
+
+	var totals UsageTotals
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if totals = spend.Report("0000-00-00", "9999-99-99", "").Total; totals.Requests > 0 {
+			break
+		}
+	}
+	if totals.Requests != 1 || totals.PromptTokens == 0 || totals.CompletionTokens == 0 || totals.Cost <= 0 {
+		t.Errorf("totals after the client hung up = %+v, want the prompt and streamed tokens charged", totals)
+	}
+}
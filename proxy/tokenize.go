@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// tokenizeRequest is the body of /api/tokenize. Content is counted as plain
+// text; Messages are counted as a chat prompt, with the per-message overhead.
+type tokenizeRequest struct {
+	Model    string                         `json:"model"`
+	Content  string                         `json:"content"`
+	Messages []openai.ChatCompletionMessage `json:"messages"`
+}
+
+// handleTokenize returns the tokens of a text for a model, with the prompt
+// cost of sending it when the model has a fixed price. Models without a
+// local vocabulary get an estimated count and no token IDs.
+func (s *server) handleTokenize(c *gin.Context) {
+	var request tokenizeRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+	if request.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	fullModelName, model, ok := s.resolveModel(c, request.Model)
+	if !ok {
+		return
+	}
+
+	tokenizer := s.tokenizers.For(fullModelName)
+	response := gin.H{
+		"model":     fullModelName,
+		"tokenizer": tokenizer.Name(),
+	}
+	count := 0
+	if request.Messages != nil {
+		count = s.tokenizers.CountMessages(fullModelName, request.Messages)
+	} else if encoder, ok := tokenizer.(Encoder); ok {
+		tokens := encoder.Encode(request.Content)
+		if tokens == nil {
+			tokens = []int{}
+		}
+		response["tokens"] = tokens
+		count = len(tokens)
+	} else {
+		count = tokenizer.Count(request.Content)
+	}
+	_, isEncoder := tokenizer.(Encoder)
+	response["count"] = count
+	response["estimated"] = !isEncoder
+	if model.Pricing.Known {
+		response["prompt_cost"] = float64(count) * model.Pricing.Prompt
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// detokenizeRequest is the body of /api/detokenize.
+type detokenizeRequest struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+// handleDetokenize returns the text of token IDs. It needs the model's
+// vocabulary, so it fails for models that are only estimated.
+func (s *server) handleDetokenize(c *gin.Context) {
+	var request detokenizeRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+	if request.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	fullModelName, _, ok := s.resolveModel(c, request.Model)
+	if !ok {
+		return
+	}
+
+	encoder, ok := s.tokenizers.For(fullModelName).(Encoder)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("no tokenizer vocabulary is loaded for %s", fullModelName)})
+		return
+	}
+	content, err := encoder.Decode(request.Tokens)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"model":     fullModelName,
+		"tokenizer": encoder.Name(),
+		"content":   content,
+	})
+}
@@ -0,0 +1,401 @@
+package proxy
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Tokenizer counts the tokens of text for a model.
+type Tokenizer interface {
+	// Name identifies the tokenizer, such as "o200k_base" or "estimate".
+	Name() string
+	Count(text string) int
+}
+
+// Encoder is a Tokenizer that can also map text to token IDs and back.
+type Encoder interface {
+	Tokenizer
+	Encode(text string) []int
+	Decode(tokens []int) (string, error)
+}
+
+// estimateTokenizer is used for models without a known vocabulary. It
+// assumes four bytes per token, which is close for English prose.
+type estimateTokenizer struct{}
+
+func (estimateTokenizer) Name() string { return "estimate" }
+
+func (estimateTokenizer) Count(text string) int { return estimateTextTokens(text) }
+
+// Pre-tokenizer patterns of the tiktoken encodings. RE2 lacks the lookahead
+// in tiktoken's "\s+(?!\S)", so the final alternative is a plain "\s+" and
+// splitPieces gives back the last character of a run followed by text.
+// Whitespace is spelled out because RE2's \s only covers ASCII.
+const (
+	wsClass         = `\t\n\v\f\r \x{85}\p{Z}`
+	contractions    = `'s|'t|'re|'ve|'m|'ll|'d`
+	cl100kPattern   = `(?i:` + contractions + `)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^` + wsClass + `\p{L}\p{N}]+[\r\n]*|[` + wsClass + `]*[\r\n]+|[` + wsClass + `]+`
+	o200kUpper      = `[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]`
+	o200kLower      = `[\p{Ll}\p{Lm}\p{Lo}\p{M}]`
+	o200kPattern    = `[^\r\n\p{L}\p{N}]?` + o200kUpper + `*` + o200kLower + `+(?i:` + contractions + `)?|[^\r\n\p{L}\p{N}]?` + o200kUpper + `+` + o200kLower + `*(?i:` + contractions + `)?|\p{N}{1,3}| ?[^` + wsClass + `\p{L}\p{N}]+[\r\n/]*|[` + wsClass + `]*[\r\n]+|[` + wsClass + `]+`
+	bpeFileSuffix   = ".tiktoken"
+	messageOverhead = 4
+	maxPieceBytes   = 4096
+)
+
+// bpePatterns maps the supported encodings to their pre-tokenizer.
+var bpePatterns = map[string]*regexp.Regexp{
+	"cl100k_base": regexp.MustCompile(cl100kPattern),
+	"o200k_base":  regexp.MustCompile(o200kPattern),
+}
+
+// BPE is a byte pair encoding compatible with OpenAI's tiktoken.
+type BPE struct {
+	name    string
+	pattern *regexp.Regexp
+	ranks   map[string]int
+	tokens  map[int]string
+}
+
+// LoadBPE reads a tiktoken rank file, the format tiktoken downloads: one
+// base64 encoded token and its rank per line. name selects the matching
+// pre-tokenizer and must be "cl100k_base" or "o200k_base".
+func LoadBPE(name, path string) (*BPE, error) {
+	pattern, ok := bpePatterns[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %q", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bpe := &BPE{name: name, pattern: pattern, ranks: make(map[string]int), tokens: make(map[int]string)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		encoded, rankText, ok := strings.Cut(scanner.Text(), " ")
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%s:%d: malformed token", path, line)
+		}
+		rank, err := strconv.Atoi(strings.TrimSpace(rankText))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: malformed rank", path, line)
+		}
+		bpe.ranks[string(token)] = rank
+		bpe.tokens[rank] = string(token)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(bpe.ranks) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return bpe, nil
+}
+
+// Name returns the encoding name.
+func (b *BPE) Name() string { return b.name }
+
+// Count returns the number of tokens in text.
+func (b *BPE) Count(text string) int { return len(b.Encode(text)) }
+
+// Encode returns the token IDs of text. Special tokens are encoded as
+// ordinary text.
+func (b *BPE) Encode(text string) []int {
+	var tokens []int
+	for _, piece := range splitPieces(b.pattern, text) {
+		if rank, ok := b.ranks[piece]; ok {
+			tokens = append(tokens, rank)
+			continue
+		}
+		tokens = append(tokens, b.mergePiece(piece)...)
+	}
+	return tokens
+}
+
+// mergePiece applies byte pair merges to piece: starting from single bytes,
+// it repeatedly joins the adjacent pair with the lowest rank, the leftmost on
+// a tie. The parts form a linked list and candidate pairs a heap, so a piece
+// of n bytes takes O(n log n) rather than tiktoken's O(n²). Pieces longer
+// than maxPieceBytes, which ordinary text never produces, are merged in
+// chunks of that size to bound the work and memory of a request.
+func (b *BPE) mergePiece(piece string) []int {
+	if len(piece) > maxPieceBytes {
+		var tokens []int
+		for len(piece) > 0 {
+			n := min(len(piece), maxPieceBytes)
+			tokens = append(tokens, b.mergePiece(piece[:n])...)
+			piece = piece[n:]
+		}
+		return tokens
+	}
+
+	// parts[i] spans piece[i:parts[i].end]; merged parts are marked dead
+	parts := make([]mergePart, len(piece))
+	for i := range parts {
+		parts[i] = mergePart{end: i + 1, prev: i - 1, next: i + 1}
+	}
+	parts[len(parts)-1].next = -1
+
+	pairs := &mergeHeap{}
+	push := func(left int) {
+		right := parts[left].next
+		if right < 0 {
+			return
+		}
+		if rank, ok := b.ranks[piece[left:parts[right].end]]; ok {
+			heap.Push(pairs, mergePair{rank: rank, left: left, right: right, end: parts[right].end})
+		}
+	}
+	for i := 0; i < len(parts)-1; i++ {
+		push(i)
+	}
+
+	for pairs.Len() > 0 {
+		pair := heap.Pop(pairs).(mergePair)
+		left, right := &parts[pair.left], &parts[pair.right]
+		// Skip pairs that earlier merges changed
+		if left.dead || right.dead || left.next != pair.right || right.end != pair.end {
+			continue
+		}
+		left.end = right.end
+		left.next = right.next
+		right.dead = true
+		if left.next >= 0 {
+			parts[left.next].prev = pair.left
+		}
+		if left.prev >= 0 {
+			push(left.prev)
+		}
+		push(pair.left)
+	}
+
+	var tokens []int
+	for i := 0; i >= 0; i = parts[i].next {
+		// Every byte has a rank in a complete vocabulary
+		if rank, ok := b.ranks[piece[i:parts[i].end]]; ok {
+			tokens = append(tokens, rank)
+		}
+	}
+	return tokens
+}
+
+// mergePart is a run of bytes of a piece during merging.
+type mergePart struct {
+	end, prev, next int
+	dead            bool
+}
+
+// mergePair is a candidate merge of two adjacent parts. end records the
+// extent of the right part, to detect that it has since grown.
+type mergePair struct {
+	rank, left, right, end int
+}
+
+// mergeHeap orders candidate merges by rank, then position.
+type mergeHeap []mergePair
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].left < h[j].left
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergePair)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	pair := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return pair
+}
+
+// Decode returns the text of tokens.
+func (b *BPE) Decode(tokens []int) (string, error) {
+	var sb strings.Builder
+	for _, token := range tokens {
+		text, ok := b.tokens[token]
+		if !ok {
+			return "", fmt.Errorf("unknown token %d for %s", token, b.name)
+		}
+		sb.WriteString(text)
+	}
+	return sb.String(), nil
+}
+
+// splitPieces pre-tokenizes text with pattern, emulating tiktoken's
+// "\s+(?!\S)": a run of spaces followed by text leaves its last space to
+// start the next piece, so " world" stays one piece after other spaces.
+func splitPieces(pattern *regexp.Regexp, text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := pattern.FindStringIndex(text)
+		if loc == nil || loc[1] == 0 {
+			// Unreachable with the tiktoken patterns, which match any
+			// character; keep the remainder rather than loop forever
+			pieces = append(pieces, text)
+			break
+		}
+		if loc[0] > 0 {
+			pieces = append(pieces, text[:loc[0]])
+		}
+		piece := text[loc[0]:loc[1]]
+		rest := text[loc[1]:]
+		if isSpaceRun(piece) && !strings.HasSuffix(piece, "\n") && !strings.HasSuffix(piece, "\r") && rest != "" {
+			if next, _ := utf8.DecodeRuneInString(rest); !unicode.IsSpace(next) {
+				if _, size := utf8.DecodeLastRuneInString(piece); size < len(piece) {
+					piece = piece[:len(piece)-size]
+				}
+			}
+		}
+		pieces = append(pieces, piece)
+		text = text[loc[0]+len(piece):]
+	}
+	return pieces
+}
+
+func isSpaceRun(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodingForModel returns the tiktoken encoding of an OpenAI model, or ""
+// for other models.
+func encodingForModel(modelID string) string {
+	name, found := strings.CutPrefix(strings.ToLower(modelID), "openai/")
+	if !found && strings.Contains(name, "/") {
+		return ""
+	}
+	for _, prefix := range []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"} {
+		if strings.HasPrefix(name, prefix) {
+			return "o200k_base"
+		}
+	}
+	for _, prefix := range []string{"gpt-4", "gpt-3.5"} {
+		if strings.HasPrefix(name, prefix) {
+			return "cl100k_base"
+		}
+	}
+	return ""
+}
+
+// Tokenizers picks the tokenizer for each model: a BPE encoding for OpenAI
+// models whose vocabulary is loaded, and an estimate for everything else. A
+// nil *Tokenizers estimates for every model.
+type Tokenizers struct {
+	encodings map[string]*BPE
+}
+
+// LoadTokenizers loads the tiktoken rank files found in dir, named after
+// their encoding, such as "o200k_base.tiktoken". Missing files are skipped;
+// their models fall back to estimates.
+func LoadTokenizers(dir string) (*Tokenizers, error) {
+	t := &Tokenizers{encodings: make(map[string]*BPE)}
+	for name := range bpePatterns {
+		path := filepath.Join(dir, name+bpeFileSuffix)
+		bpe, err := LoadBPE(name, path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.encodings[name] = bpe
+	}
+	return t, nil
+}
+
+// Encodings returns the names of the loaded encodings.
+func (t *Tokenizers) Encodings() []string {
+	if t == nil {
+		return nil
+	}
+	names := make([]string, 0, len(t.encodings))
+	for name := range t.encodings {
+		names = append(names, name)
+	}
+	return names
+}
+
+// For returns the tokenizer for a full model ID.
+func (t *Tokenizers) For(modelID string) Tokenizer {
+	if t != nil {
+		if bpe, ok := t.encodings[encodingForModel(modelID)]; ok {
+			return bpe
+		}
+	}
+	return estimateTokenizer{}
+}
+
+const (
+	// toolCallOverhead covers the structure around a tool call's name and
+	// arguments.
+	toolCallOverhead = 8
+	// OpenAI's image costs: 85 tokens for low detail, plus 170 per 512px
+	// tile for high detail, four tiles for a 1024x1024 image.
+	lowDetailImageTokens  = 85
+	highDetailImageTokens = 85 + 4*170
+)
+
+// CountMessages returns the prompt tokens of messages for a model: their
+// text, names, tool calls and images, plus a small overhead per message for
+// the chat format. Images are counted at OpenAI's cost of a high detail
+// 1024x1024 image, or of a low detail one when the client asks for it, as
+// their size is not known without fetching them.
+func (t *Tokenizers) CountMessages(modelID string, messages []openai.ChatCompletionMessage) int {
+	tokenizer := t.For(modelID)
+	tokens := 0
+	for _, m := range messages {
+		tokens += messageOverhead + tokenizer.Count(m.Content)
+		if m.Name != "" {
+			tokens += 1 + tokenizer.Count(m.Name)
+		}
+		if m.ToolCallID != "" {
+			tokens += tokenizer.Count(m.ToolCallID)
+		}
+		for _, part := range m.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				tokens += imageTokens(part.ImageURL)
+				continue
+			}
+			tokens += tokenizer.Count(part.Text)
+		}
+		for _, call := range m.ToolCalls {
+			tokens += toolCallOverhead + tokenizer.Count(call.ID) +
+				tokenizer.Count(call.Function.Name) + tokenizer.Count(call.Function.Arguments)
+		}
+		if call := m.FunctionCall; call != nil {
+			tokens += toolCallOverhead + tokenizer.Count(call.Name) + tokenizer.Count(call.Arguments)
+		}
+	}
+	return tokens
+}
+
+// imageTokens returns the prompt tokens of an image part.
+func imageTokens(image *openai.ChatMessageImageURL) int {
+	if image != nil && image.Detail == openai.ImageURLDetailLow {
+		return lowDetailImageTokens
+	}
+	return highDetailImageTokens
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// writeRankFile writes a tiny tiktoken rank file to dir: every single byte,
+// ranked by its value, followed by merges spelling "hello" and " world".
+func writeRankFile(t *testing.T, dir, name string) {
+	t.Helper()
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, token := range []string{"he", "ll", "hell", "hello", " world"} {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), 256+i)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+bpeFileSuffix), []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitPieces(t *testing.T) {
+	pattern := bpePatterns["cl100k_base"]
+	for _, tc := range []struct {
+		text string
+		want []string
+	}{
+		{"Hello world", []string{"Hello", " world"}},
+		{"  hi", []string{" ", " hi"}},
+		{"123456", []string{"123", "456"}},
+		{"don't", []string{"don", "'t"}},
+		{"a\n\nb", []string{"a", "\n\n", "b"}},
+		{"end  ", []string{"end", "  "}},
+	} {
+		if got := splitPieces(pattern, tc.text); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitPieces(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestBPEEncodeDecode(t *testing.T) {
+	dir := t.TempDir()
+	writeRankFile(t, dir, "cl100k_base")
+	bpe, err := LoadBPE("cl100k_base", filepath.Join(dir, "cl100k_base"+bpeFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		text string
+		want []int
+	}{
+		{"hello world", []int{259, 260}},
+		// "hellos" is not a token, so its bytes are merged pair by pair
+		{"hellos", []int{259, 's'}},
+		{"hi!", []int{'h', 'i', '!'}},
+	} {
+		tokens := bpe.Encode(tc.text)
+		if !reflect.DeepEqual(tokens, tc.want) {
+			t.Errorf("Encode(%q) = %v, want %v", tc.text, tokens, tc.want)
+		}
+		text, err := bpe.Decode(tokens)
+		if err != nil || text != tc.text {
+			t.Errorf("Decode(%v) = %q, %v; want %q", tokens, text, err, tc.text)
+		}
+	}
+
+	if _, err := bpe.Decode([]int{100000}); err == nil {
+		t.Error("Decode of an unknown token succeeded")
+	}
+}
+
+// naiveMerge is the textbook byte pair merge that mergePiece must agree with.
+func naiveMerge(b *BPE, piece string) []int {
+	parts := make([]string, 0, len(piece))
+	for i := range piece {
+		parts = append(parts, piece[i:i+1])
+	}
+	for {
+		best, bestRank := -1, 0
+		for i := 0; i+1 < len(parts); i++ {
+			if rank, ok := b.ranks[parts[i]+parts[i+1]]; ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts[best] += parts[best+1]
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+	tokens := make([]int, len(parts))
+	for i, part := range parts {
+		tokens[i] = b.ranks[part]
+	}
+	return tokens
+}
+
+func TestBPEMergePiece(t *testing.T) {
+	dir := t.TempDir()
+	writeRankFile(t, dir, "cl100k_base")
+	bpe, err := LoadBPE("cl100k_base", filepath.Join(dir, "cl100k_base"+bpeFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, piece := range []string{"hellhello", "hhellllo", "llll", "hehehe", "helloworldhello", "xhellox"} {
+		if got, want := bpe.mergePiece(piece), naiveMerge(bpe, piece); !reflect.DeepEqual(got, want) {
+			t.Errorf("mergePiece(%q) = %v, want %v", piece, got, want)
+		}
+	}
+
+	// A long run of letters is one piece; it must not take quadratic time
+	long := strings.Repeat("hello", 200_000)
+	start := time.Now()
+	tokens := bpe.Encode(long)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("encoding %d bytes took %v", len(long), elapsed)
+	}
+	if text, err := bpe.Decode(tokens); err != nil || text != long {
+		t.Errorf("long piece does not round trip: %v", err)
+	}
+}
+
+func TestEncodingForModel(t *testing.T) {
+	for model, want := range map[string]string{
+		"openai/gpt-4o":                   "o200k_base",
+		"openai/gpt-4o-mini":              "o200k_base",
+		"openai/o3-mini":                  "o200k_base",
+		"openai/gpt-4-turbo":              "cl100k_base",
+		"openai/gpt-3.5-turbo":            "cl100k_base",
+		"gpt-4o":                          "o200k_base",
+		"meta-llama/llama-3-70b-instruct": "",
+		"anthropic/claude-3.5-sonnet":     "",
+	} {
+		if got := encodingForModel(model); got != want {
+			t.Errorf("encodingForModel(%q) = %q, want %q", model, got, want)
+		}
+	}
+}
+
+func TestLoadTokenizers(t *testing.T) {
+	dir := t.TempDir()
+	writeRankFile(t, dir, "o200k_base")
+	tokenizers, err := LoadTokenizers(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tokenizers.Encodings(); !reflect.DeepEqual(got, []string{"o200k_base"}) {
+		t.Errorf("Encodings() = %v, want [o200k_base]", got)
+	}
+	if got := tokenizers.For("openai/gpt-4o").Name(); got != "o200k_base" {
+		t.Errorf("tokenizer for gpt-4o = %q, want o200k_base", got)
+	}
+	// The cl100k vocabulary is missing, so older models are estimated
+	if got := tokenizers.For("openai/gpt-4-turbo").Name(); got != "estimate" {
+		t.Errorf("tokenizer for gpt-4-turbo = %q, want estimate", got)
+	}
+
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hello world"}}
+	if got := tokenizers.CountMessages("openai/gpt-4o", messages); got != messageOverhead+2 {
+		t.Errorf("CountMessages = %d, want %d", got, messageOverhead+2)
+	}
+	var none *Tokenizers
+	if got, want := none.CountMessages("openai/gpt-4o", messages), estimateTokens(messages); got != want {
+		t.Errorf("CountMessages without tokenizers = %d, want the estimate %d", got, want)
+	}
+}
+
+func TestCountMessagesToolsAndImages(t *testing.T) {
+	var tokenizers *Tokenizers
+	plain := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleAssistant}}
+	base := tokenizers.CountMessages("openai/gpt-4o", plain)
+
+	for _, tc := range []struct {
+		name    string
+		message openai.ChatCompletionMessage
+		want    int
+	}{
+		{"name", openai.ChatCompletionMessage{Name: "alice123"}, 1 + 2},
+		{"tool result", openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, ToolCallID: "call_0001"}, 3},
+		{"tool call", openai.ChatCompletionMessage{ToolCalls: []openai.ToolCall{{
+			ID:       "call_0001",
+			Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+		}}}, toolCallOverhead + 3 + 3 + 4},
+		{"image", openai.ChatCompletionMessage{MultiContent: []openai.ChatMessagePart{{
+			Type:     openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/cat.png"},
+		}}}, highDetailImageTokens},
+		{"low detail image", openai.ChatCompletionMessage{MultiContent: []openai.ChatMessagePart{{
+			Type:     openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/cat.png", Detail: openai.ImageURLDetailLow},
+		}}}, lowDetailImageTokens},
+	} {
+		got := tokenizers.CountMessages("openai/gpt-4o", []openai.ChatCompletionMessage{tc.message}) - base
+		if got != tc.want {
+			t.Errorf("%s: counted %d tokens, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTokenizeEndpoints(t *testing.T) {
+	dir := t.TempDir()
+	writeRankFile(t, dir, "o200k_base")
+	p := newTestProxy(t, func(o *Options) {
+		var err error
+		if o.Tokenizers, err = LoadTokenizers(dir); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	w := p.do(t, http.MethodPost, "/api/tokenize", map[string]interface{}{"model": "gpt-4o", "content": "hello world"})
+	expectStatus(t, w, http.StatusOK)
+	body := decodeJSON(t, w)
+	if body["model"] != "openai/gpt-4o" || body["tokenizer"] != "o200k_base" || body["count"] != 2.0 || body["estimated"] != false {
+		t.Errorf("tokenize response = %v", body)
+	}
+	if !reflect.DeepEqual(body["tokens"], []interface{}{259.0, 260.0}) {
+		t.Errorf("tokens = %v, want [259 260]", body["tokens"])
+	}
+	if body["prompt_cost"] != 2*0.000001 {
+		t.Errorf("prompt_cost = %v, want %v", body["prompt_cost"], 2*0.000001)
+	}
+
+	w = p.do(t, http.MethodPost, "/api/detokenize", map[string]interface{}{"model": "gpt-4o", "tokens": []int{259, 260}})
+	expectStatus(t, w, http.StatusOK)
+	if body := decodeJSON(t, w); body["content"] != "hello world" {
+		t.Errorf("detokenize response = %v", body)
+	}
+
+	w = p.do(t, http.MethodPost, "/api/detokenize", map[string]interface{}{"model": "gpt-4o", "tokens": []int{999999}})
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestTokenizeEstimate(t *testing.T) {
+	p := newTestProxy(t)
+
+	w := p.do(t, http.MethodPost, "/api/tokenize", map[string]interface{}{
+		"model":    "meta-llama/llama-3-70b-instruct",
+		"messages": []map[string]string{{"role": "user", "content": strings.Repeat("x", 40)}},
+	})
+	expectStatus(t, w, http.StatusOK)
+	body := decodeJSON(t, w)
+	if body["tokenizer"] != "estimate" || body["count"] != 14.0 || body["estimated"] != true {
+		t.Errorf("tokenize response = %v", body)
+	}
+	if _, ok := body["tokens"]; ok {
+		t.Error("estimated response has token IDs")
+	}
+
+	w = p.do(t, http.MethodPost, "/api/tokenize", map[string]interface{}{"model": "openrouter/auto", "content": "hi"})
+	expectStatus(t, w, http.StatusOK)
+	if body := decodeJSON(t, w); body["prompt_cost"] != nil {
+		t.Errorf("prompt_cost of a variable-priced model = %v, want none", body["prompt_cost"])
+	}
+
+	w = p.do(t, http.MethodPost, "/api/detokenize", map[string]interface{}{"model": "meta-llama/llama-3-70b-instruct", "tokens": []int{1}})
+	expectStatus(t, w, http.StatusBadRequest)
+
+	w = p.do(t, http.MethodPost, "/api/tokenize", map[string]interface{}{"content": "hi"})
+	expectStatus(t, w, http.StatusBadRequest)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"os"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "ollama-openrouter-proxy"
+
+// tracer creates the proxy's spans. Until tracing is set up it uses the
+// global no-op provider, so instrumented code costs next to nothing.
+var tracer = otel.Tracer(serviceName)
+
+// Span attribute keys shared by handlers and the provider.
+var (
+	attrModel            = attribute.Key("llm.model")
+	attrRequestedModel   = attribute.Key("llm.requested_model")
+	attrPromptTokens     = attribute.Key("llm.usage.prompt_tokens")
+	attrCompletionTokens = attribute.Key("llm.usage.completion_tokens")
+	attrFinishReason     = attribute.Key("llm.finish_reason")
+	attrStream           = attribute.Key("llm.stream")
+)
+
+// TracingEnabled reports whether an OTLP endpoint is configured through the
+// standard OpenTelemetry environment variables.
+func TracingEnabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// NewOTLPExporter creates an OTLP/HTTP exporter configured from the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func NewOTLPExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	return otlptracehttp.New(ctx)
+}
+
+// SetupTracing installs a global tracer provider that sends spans to
+// exporter. Tests can pass an in-memory exporter. The returned function
+// flushes pending spans and must be called before exiting.
+func SetupTracing(exporter sdktrace.SpanExporter) func(context.Context) error {
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startRelaySpan starts the span covering relaying a stream to the client.
+func startRelaySpan(ctx context.Context, model string) trace.Span {
+	_, span := tracer.Start(ctx, "stream_relay", trace.WithAttributes(attrModel.String(model)))
+	return span
+}
+
+// endRelaySpan records the outcome of a relayed stream and ends its span.
+func endRelaySpan(span trace.Span, usage openai.Usage, finishReason string, err error) {
+	span.SetAttributes(
+		attrPromptTokens.Int(usage.PromptTokens),
+		attrCompletionTokens.Int(usage.CompletionTokens),
+		attrFinishReason.String(finishReason),
+	)
+	endSpan(span, err)
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestResolveModelSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown := SetupTracing(exporter)
+	defer shutdown(context.Background())
+
+	keys, err := ParseKeyPool("sk-or-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewOpenrouterProvider(keys, "")
+	provider.modelNames = []string{"openai/gpt-4o", "mistralai/mistral-large"}
+
+	if _, err := provider.GetFullModelName(context.Background(), "gpt-4o"); err != nil {
+		t.Fatal(err)
+	}
+	if err := otel.GetTracerProvider().(*sdktrace.TracerProvider).ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "resolve_model" {
+		t.Fatalf("spans = %v, want a single resolve_model span", spans.Snapshots())
+	}
+
+	attrs := make(map[string]string)
+	for _, kv := range spans[0].Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["llm.requested_model"] != "gpt-4o" || attrs["llm.model"] != "openai/gpt-4o" || attrs["catalog.cached"] != "true" {
+		t.Fatalf("unexpected span attributes: %v", attrs)
+	}
+}